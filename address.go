@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"slices"
+
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// Address families accepted by the address_family option.
+const (
+	addressFamilyIPv4       = "ipv4"
+	addressFamilyIPv6       = "ipv6"
+	addressFamilyPreferIPv4 = "prefer_ipv4"
+	addressFamilyPreferIPv6 = "prefer_ipv6"
+)
+
+// addressPolicy decides which of the addresses reported by the guest may be
+// used to connect to an instance, and in which order they are preferred.
+// The zero value accepts IPv4 addresses on any network.
+//
+// Loopback and link-local addresses are never used, nor are addresses on
+// interfaces that are not backed by a virtual NIC, such as docker0 or veth
+// devices created inside the guest.
+type addressPolicy struct {
+	family  string
+	cidrs   []*net.IPNet
+	network string
+
+	excludeCIDRs    []*net.IPNet
+	excludeNetworks []string
+}
+
+// newAddressPolicy builds an address policy. Entries in exclude are either
+// CIDRs or IP addresses to skip, or names of networks whose NICs are skipped.
+func newAddressPolicy(family string, cidrs []string, network string, exclude []string) (addressPolicy, error) {
+	switch family {
+	case "":
+		family = addressFamilyIPv4
+	case addressFamilyIPv4, addressFamilyIPv6, addressFamilyPreferIPv4, addressFamilyPreferIPv6:
+	default:
+		return addressPolicy{}, fmt.Errorf("unsupported address family: %s", family)
+	}
+
+	policy := addressPolicy{family: family, network: network}
+	for _, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return addressPolicy{}, err
+		}
+		policy.cidrs = append(policy.cidrs, ipNet)
+	}
+
+	for _, entry := range exclude {
+		if _, ipNet, err := net.ParseCIDR(entry); err == nil {
+			policy.excludeCIDRs = append(policy.excludeCIDRs, ipNet)
+			continue
+		}
+		if ip := net.ParseIP(entry); ip != nil {
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			policy.excludeCIDRs = append(policy.excludeCIDRs, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		policy.excludeNetworks = append(policy.excludeNetworks, entry)
+	}
+	return policy, nil
+}
+
+// addresses returns the guest addresses that match the policy, most
+// preferred first. The guest's primary address is preferred over others of
+// the same family.
+func (p addressPolicy) addresses(guest *types.GuestInfo) []string {
+	if guest == nil {
+		return nil
+	}
+
+	var preferred, others []string
+	for _, nic := range guest.Net {
+		if mac := nic.MacAddress; mac == "" {
+			continue
+		}
+		if nic.IpConfig == nil {
+			continue
+		}
+		// Interfaces created inside the guest, such as docker0, are not
+		// backed by a virtual device.
+		if nic.DeviceConfigId < 0 {
+			continue
+		}
+		if p.network != "" && nic.Network != p.network {
+			continue
+		}
+		if slices.Contains(p.excludeNetworks, nic.Network) {
+			continue
+		}
+
+		for _, vmIP := range nic.IpAddress {
+			ip := net.ParseIP(vmIP)
+			if ip == nil || !p.matches(ip) {
+				continue
+			}
+			if p.family == addressFamilyPreferIPv6 && ip.To4() != nil ||
+				p.family == addressFamilyPreferIPv4 && ip.To4() == nil {
+				others = appendAddress(others, vmIP, guest.IpAddress)
+				continue
+			}
+			preferred = appendAddress(preferred, vmIP, guest.IpAddress)
+		}
+	}
+
+	return append(preferred, others...)
+}
+
+// appendAddress appends addr to addrs, or prepends it if it is the guest's
+// primary address.
+func appendAddress(addrs []string, addr string, primary string) []string {
+	if addr == primary {
+		return append([]string{addr}, addrs...)
+	}
+	return append(addrs, addr)
+}
+
+// primary returns the most preferred guest address, or an empty string if
+// there is none.
+func (p addressPolicy) primary(guest *types.GuestInfo) string {
+	if addrs := p.addresses(guest); len(addrs) > 0 {
+		return addrs[0]
+	}
+	return ""
+}
+
+func (p addressPolicy) matches(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsUnspecified() {
+		return false
+	}
+	for _, cidr := range p.excludeCIDRs {
+		if cidr.Contains(ip) {
+			return false
+		}
+	}
+
+	isV4 := ip.To4() != nil
+	switch p.family {
+	case "", addressFamilyIPv4:
+		if !isV4 {
+			return false
+		}
+	case addressFamilyIPv6:
+		if isV4 {
+			return false
+		}
+	}
+
+	if len(p.cidrs) == 0 {
+		return true
+	}
+	for _, cidr := range p.cidrs {
+		if cidr.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
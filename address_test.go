@@ -0,0 +1,121 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+func TestAddressPolicy(t *testing.T) {
+	guest := &types.GuestInfo{Net: []types.GuestNicInfo{
+		{
+			MacAddress:     "00:50:56:00:00:01",
+			DeviceConfigId: 4000,
+			Network:        "VM Network",
+			IpConfig:       &types.NetIpConfigInfo{},
+			IpAddress:      []string{"10.0.0.5", "2001:db8::5"},
+		},
+		{
+			MacAddress:     "00:50:56:00:00:02",
+			DeviceConfigId: 4001,
+			Network:        "CI Network",
+			IpConfig:       &types.NetIpConfigInfo{},
+			IpAddress:      []string{"2001:db8:1::7", "192.168.1.7"},
+		},
+	}}
+
+	tests := []struct {
+		name    string
+		family  string
+		cidrs   []string
+		network string
+		want    []string
+	}{
+		{
+			name: "default is IPv4 only",
+			want: []string{"10.0.0.5", "192.168.1.7"},
+		},
+		{
+			name:   "IPv6 only",
+			family: "ipv6",
+			want:   []string{"2001:db8::5", "2001:db8:1::7"},
+		},
+		{
+			name:   "prefer IPv6",
+			family: "prefer_ipv6",
+			want:   []string{"2001:db8::5", "2001:db8:1::7", "10.0.0.5", "192.168.1.7"},
+		},
+		{
+			name:   "restricted to CIDR",
+			family: "prefer_ipv4",
+			cidrs:  []string{"192.168.0.0/16", "2001:db8:1::/48"},
+			want:   []string{"192.168.1.7", "2001:db8:1::7"},
+		},
+		{
+			name:    "restricted to network",
+			family:  "ipv6",
+			network: "CI Network",
+			want:    []string{"2001:db8:1::7"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy, err := newAddressPolicy(tt.family, tt.cidrs, tt.network, nil)
+			if err != nil {
+				t.Fatalf("newAddressPolicy() failed: %v", err)
+			}
+			if got := policy.addresses(guest); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("addresses() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAddressPolicyInvalid(t *testing.T) {
+	if _, err := newAddressPolicy("ipv5", nil, "", nil); err == nil {
+		t.Error("expected an error for an unknown address family")
+	}
+	if _, err := newAddressPolicy("", []string{"10.0.0.0"}, "", nil); err == nil {
+		t.Error("expected an error for an invalid CIDR")
+	}
+}
+
+func TestAddressPolicyFiltering(t *testing.T) {
+	guest := &types.GuestInfo{
+		IpAddress: "10.0.0.6",
+		Net: []types.GuestNicInfo{
+			{
+				MacAddress:     "00:50:56:00:00:01",
+				DeviceConfigId: 4000,
+				Network:        "VM Network",
+				IpConfig:       &types.NetIpConfigInfo{},
+				IpAddress:      []string{"169.254.10.1", "fe80::1", "10.0.0.5", "10.0.0.6", "10.99.0.1"},
+			},
+			{
+				MacAddress:     "02:42:ac:11:00:01",
+				DeviceConfigId: -1,
+				IpConfig:       &types.NetIpConfigInfo{},
+				IpAddress:      []string{"172.17.0.1"},
+			},
+			{
+				MacAddress:     "00:50:56:00:00:02",
+				DeviceConfigId: 4001,
+				Network:        "Storage Network",
+				IpConfig:       &types.NetIpConfigInfo{},
+				IpAddress:      []string{"192.168.1.7"},
+			},
+		},
+	}
+
+	policy, err := newAddressPolicy("prefer_ipv4", nil, "", []string{"10.99.0.0/16", "Storage Network"})
+	if err != nil {
+		t.Fatalf("newAddressPolicy() failed: %v", err)
+	}
+
+	want := []string{"10.0.0.6", "10.0.0.5"}
+	if got := policy.addresses(guest); !reflect.DeepEqual(got, want) {
+		t.Errorf("addresses() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/vmware/govmomi/find"
+	"github.com/vmware/govmomi/vim25/methods"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// capacity estimates how many instances the configured resources can host:
+// the instances that exist already plus the resource pool's unreserved CPU
+// and memory headroom, the datastore free space divided by the template's
+// provisioned size, and the size of the vCenter IP pool associated with the
+// network. Each limit is logged; the lowest one wins.
+func (k *vSphereDeployment) capacity(ctx context.Context) (int, error) {
+	finder := find.NewFinder(k.client.Client, false)
+
+	dc, err := finder.Datacenter(ctx, k.Datacenter)
+	if err != nil {
+		return 0, fmt.Errorf("failed to find datacenter '%s': %w", k.Datacenter, err)
+	}
+	finder.SetDatacenter(dc)
+
+	cpuCount, err := strconv.ParseInt(k.Cpu, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid CPU count: %v", err)
+	}
+	memoryMB, err := strconv.ParseInt(k.Memory, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid memory size: %v", err)
+	}
+	if cpuCount <= 0 || memoryMB <= 0 {
+		return 0, fmt.Errorf("cpu and memory must be positive")
+	}
+
+	vms, err := k.listVMs(ctx, []string{"name"})
+	if err != nil {
+		return 0, err
+	}
+	existing := 0
+	for _, vm := range vms {
+		if k.isInstance(vm.Name) {
+			existing++
+		}
+	}
+
+	limits := make(map[string]int)
+
+	rp, err := finder.ResourcePool(ctx, k.Resourcepool)
+	if err != nil {
+		return 0, fmt.Errorf("failed to find resource pool: %v", err)
+	}
+	var rpInfo mo.ResourcePool
+	if err := rp.Properties(ctx, rp.Reference(), []string{"runtime"}, &rpInfo); err != nil {
+		return 0, err
+	}
+	limits["memory"] = existing + int(rpInfo.Runtime.Memory.UnreservedForVm/(memoryMB*1024*1024))
+
+	cluster, err := finder.ClusterComputeResource(ctx, k.Cluster)
+	if err != nil {
+		return 0, fmt.Errorf("failed to find cluster: %v", err)
+	}
+	var clusterInfo mo.ClusterComputeResource
+	if err := cluster.Properties(ctx, cluster.Reference(), []string{"summary"}, &clusterInfo); err != nil {
+		return 0, err
+	}
+	if clusterInfo.Summary != nil {
+		summary := clusterInfo.Summary.GetComputeResourceSummary()
+		if summary.NumCpuCores > 0 && summary.TotalCpu > 0 {
+			mhzPerCore := int64(summary.TotalCpu) / int64(summary.NumCpuCores)
+			limits["cpu"] = existing + int(rpInfo.Runtime.Cpu.UnreservedForVm/(cpuCount*mhzPerCore))
+		}
+	}
+
+	// Instant and linked clones share the parent's disks, so only full
+	// copies and additional disks are bounded by datastore space.
+	if k.copiesDisks() || k.vmDatastoreDiskBytes() > 0 {
+		template, err := finder.VirtualMachine(ctx, k.Template)
+		if err != nil {
+			return 0, fmt.Errorf("failed to find source template VM '%s': %w", k.Template, err)
+		}
+		var templateInfo mo.VirtualMachine
+		if err := template.Properties(ctx, template.Reference(), []string{"summary.storage"}, &templateInfo); err != nil {
+			return 0, err
+		}
+
+		datastores := k.Datastores
+		if len(datastores) == 0 {
+			datastores = []string{k.Datastore}
+		}
+		var freeSpace int64
+		for _, datastore := range datastores {
+			free, err := datastoreFreeSpace(ctx, finder, datastore)
+			if err != nil {
+				return 0, err
+			}
+			freeSpace += free
+		}
+
+		size := k.vmDatastoreDiskBytes()
+		if storage := templateInfo.Summary.Storage; storage != nil && k.copiesDisks() {
+			size += storage.Committed + storage.Uncommitted
+		}
+		if size > 0 {
+			limits["datastore"] = existing + int(freeSpace/size)
+		}
+	}
+
+	if k.client.ServiceContent.IpPoolManager != nil {
+		res, err := methods.QueryIpPools(ctx, k.client.Client, &types.QueryIpPools{
+			This: *k.client.ServiceContent.IpPoolManager,
+			Dc:   dc.Reference(),
+		})
+		if err != nil {
+			return 0, fmt.Errorf("failed to query IP pools: %w", err)
+		}
+		for _, pool := range res.Returnval {
+			if !ipPoolServesNetwork(pool, k.Network) {
+				continue
+			}
+			if size := ipPoolSize(pool); size > 0 {
+				limits["ip pool"] += size
+			}
+		}
+	}
+
+	capacity := -1
+	for resource, limit := range limits {
+		k.logger().Info("capacity limit", "resource", resource, "instances", limit)
+		if capacity < 0 || limit < capacity {
+			capacity = limit
+		}
+	}
+	return capacity, nil
+}
+
+// copiesDisks reports whether the deploy type copies the template's disks
+// rather than sharing them with the clone.
+func (k *vSphereDeployment) copiesDisks() bool {
+	return k.Deploytype != "instantclone" && k.Deploytype != "linkedclone"
+}
+
+// ipPoolServesNetwork reports whether pool is associated with network.
+func ipPoolServesNetwork(pool types.IpPool, network string) bool {
+	for _, assoc := range pool.NetworkAssociation {
+		if assoc.NetworkName == network {
+			return true
+		}
+	}
+	return false
+}
+
+// ipPoolSize returns the number of addresses in the pool's IPv4 and IPv6
+// ranges. Ranges have the form "192.168.0.10#10, 192.168.0.30#5".
+func ipPoolSize(pool types.IpPool) int {
+	size := 0
+	for _, config := range []*types.IpPoolIpPoolConfigInfo{pool.Ipv4Config, pool.Ipv6Config} {
+		if config == nil || (config.IpPoolEnabled != nil && !*config.IpPoolEnabled) {
+			continue
+		}
+		for _, r := range strings.Split(config.Range, ",") {
+			addr, count, ok := strings.Cut(strings.TrimSpace(r), "#")
+			if !ok || net.ParseIP(addr) == nil {
+				continue
+			}
+			n, err := strconv.Atoi(count)
+			if err != nil {
+				continue
+			}
+			size += n
+		}
+	}
+	return size
+}
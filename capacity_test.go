@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/vmware/govmomi/vim25/types"
+	"gitlab.com/gitlab-org/fleeting/fleeting/provider"
+)
+
+func TestIpPoolSize(t *testing.T) {
+	disabled := false
+	pool := types.IpPool{
+		Ipv4Config: &types.IpPoolIpPoolConfigInfo{Range: "192.168.0.10#10, 192.168.0.30#5"},
+		Ipv6Config: &types.IpPoolIpPoolConfigInfo{Range: "2001:db8::10#100", IpPoolEnabled: &disabled},
+	}
+
+	if got := ipPoolSize(pool); got != 15 {
+		t.Errorf("ipPoolSize() = %d, want 15", got)
+	}
+}
+
+func TestVSphereDeployment_InitMaxSize(t *testing.T) {
+	withTestVSphere(t, func(ctx context.Context, deployment *vSphereDeployment) {
+		deployment.MaxSize = 10
+		info, err := deployment.Init(ctx, nil, provider.Settings{})
+		if err != nil {
+			t.Fatalf("Init() failed: %v", err)
+		}
+		if info.MaxSize != 10 {
+			t.Errorf("Expected MaxSize to be 10, got %d", info.MaxSize)
+		}
+
+		deployment.MaxSizeFromCapacity = true
+		deployment.Memory = "1048576000"
+		info, err = deployment.Init(ctx, nil, provider.Settings{})
+		if err != nil {
+			t.Fatalf("Init() failed: %v", err)
+		}
+		if info.MaxSize != 0 {
+			t.Errorf("Expected MaxSize to be limited by memory to 0, got %d", info.MaxSize)
+		}
+	})
+}
+
+func TestVSphereDeployment_CapacityIgnoresPool(t *testing.T) {
+	withTestVSphere(t, func(ctx context.Context, deployment *vSphereDeployment) {
+		deployment.WarmPoolSize = 2
+		if err := deployment.refillPool(ctx); err != nil {
+			t.Fatalf("refillPool() failed: %v", err)
+		}
+
+		// Memory alone leaves no headroom, so the capacity is the number of
+		// existing instances, which warm pool VMs are not.
+		deployment.Memory = "1048576000"
+		got, err := deployment.capacity(ctx)
+		if err != nil {
+			t.Fatalf("capacity() failed: %v", err)
+		}
+		if got != 0 {
+			t.Errorf("Expected the warm pool not to count as instances, got capacity %d", got)
+		}
+	})
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	"github.com/vmware/govmomi/find"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// Disk provisioning types accepted in the disks option.
+const (
+	diskProvisioningThin        = "thin"
+	diskProvisioningThick       = "thick"
+	diskProvisioningEagerZeroed = "eager_zeroed"
+)
+
+// Disk controller types accepted in the disks option.
+const (
+	diskControllerSCSI = "scsi"
+	diskControllerNVMe = "nvme"
+	diskControllerSATA = "sata"
+)
+
+// Disk modes accepted in the disks option. Independent disks are left out of
+// snapshots; writes to independent nonpersistent disks are discarded when
+// the VM powers off.
+var diskModes = map[string]types.VirtualDiskMode{
+	"persistent":                types.VirtualDiskModePersistent,
+	"independent_persistent":    types.VirtualDiskModeIndependent_persistent,
+	"independent_nonpersistent": types.VirtualDiskModeIndependent_nonpersistent,
+}
+
+// diskConfig describes an additional disk attached to every instance.
+type diskConfig struct {
+	SizeGB       int64  `json:"size_gb"`
+	Provisioning string `json:"provisioning"`
+	Datastore    string `json:"datastore"`
+	Controller   string `json:"controller"`
+	Mode         string `json:"mode"`
+}
+
+// validate checks the disk configuration.
+func (d diskConfig) validate() error {
+	if d.SizeGB <= 0 {
+		return fmt.Errorf("size_gb must be positive")
+	}
+	switch d.Provisioning {
+	case "", diskProvisioningThin, diskProvisioningThick, diskProvisioningEagerZeroed:
+	default:
+		return fmt.Errorf("unsupported provisioning: %s", d.Provisioning)
+	}
+	switch d.Controller {
+	case "", diskControllerSCSI, diskControllerNVMe, diskControllerSATA:
+	default:
+		return fmt.Errorf("unsupported controller: %s", d.Controller)
+	}
+	if _, ok := diskModes[d.Mode]; d.Mode != "" && !ok {
+		return fmt.Errorf("unsupported mode: %s", d.Mode)
+	}
+	return nil
+}
+
+// diskChanges returns the device changes that grow the template's primary
+// disk to disk_size_gb and add the configured disks.
+func (k *vSphereDeployment) diskChanges(ctx context.Context, finder *find.Finder, srcVM *object.VirtualMachine) ([]types.BaseVirtualDeviceConfigSpec, error) {
+	if k.DiskSizeGB == 0 && len(k.Disks) == 0 {
+		return nil, nil
+	}
+
+	devices, err := srcVM.Device(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get template devices: %w", err)
+	}
+
+	var changes []types.BaseVirtualDeviceConfigSpec
+	if k.DiskSizeGB > 0 {
+		disks := devices.SelectByType((*types.VirtualDisk)(nil))
+		if len(disks) == 0 {
+			return nil, fmt.Errorf("template has no disk to resize")
+		}
+		disk := disks[0].(*types.VirtualDisk)
+		size := gigabytes(k.DiskSizeGB)
+		if size < disk.CapacityInBytes {
+			return nil, fmt.Errorf("disk_size_gb %d is smaller than the template's disk of %d bytes", k.DiskSizeGB, disk.CapacityInBytes)
+		}
+		if size > disk.CapacityInBytes {
+			disk.CapacityInBytes = size
+			disk.CapacityInKB = size / 1024
+			changes = append(changes, &types.VirtualDeviceConfigSpec{
+				Operation: types.VirtualDeviceConfigSpecOperationEdit,
+				Device:    disk,
+			})
+		}
+	}
+
+	for _, d := range k.Disks {
+		controller, err := diskController(devices, d.Controller)
+		if err != nil {
+			return nil, err
+		}
+
+		// Without a datastore the disk is placed with the VM.
+		var dsRef types.ManagedObjectReference
+		var name string
+		if d.Datastore != "" {
+			ds, err := finder.Datastore(ctx, d.Datastore)
+			if err != nil {
+				return nil, fmt.Errorf("failed to find datastore '%s': %w", d.Datastore, err)
+			}
+			dsRef = ds.Reference()
+			name = fmt.Sprintf("[%s]", ds.Name())
+		}
+
+		disk := devices.CreateDisk(controller, dsRef, name)
+		disk.CapacityInBytes = gigabytes(d.SizeGB)
+		disk.CapacityInKB = disk.CapacityInBytes / 1024
+		backing := disk.Backing.(*types.VirtualDiskFlatVer2BackingInfo)
+		switch d.Provisioning {
+		case diskProvisioningThick:
+			backing.ThinProvisioned = types.NewBool(false)
+		case diskProvisioningEagerZeroed:
+			backing.ThinProvisioned = types.NewBool(false)
+			backing.EagerlyScrub = types.NewBool(true)
+		}
+		if mode, ok := diskModes[d.Mode]; ok {
+			backing.DiskMode = string(mode)
+		}
+
+		// Later disks must not get the same unit number.
+		devices = append(devices, disk)
+		changes = append(changes, &types.VirtualDeviceConfigSpec{
+			Operation:     types.VirtualDeviceConfigSpecOperationAdd,
+			FileOperation: types.VirtualDeviceConfigSpecFileOperationCreate,
+			Device:        disk,
+		})
+	}
+
+	return changes, nil
+}
+
+// diskController returns the template's first controller of the given type.
+func diskController(devices object.VirtualDeviceList, controller string) (types.BaseVirtualController, error) {
+	switch controller {
+	case "", diskControllerSCSI:
+		return devices.FindSCSIController("")
+	case diskControllerNVMe:
+		return devices.FindNVMEController("")
+	case diskControllerSATA:
+		return devices.FindSATAController("")
+	}
+	return nil, fmt.Errorf("unsupported controller: %s", controller)
+}
+
+// diskDatastores returns the datastores the configured disks are placed on,
+// apart from the instance's own datastore. Instances can only run on hosts
+// that mount all of them, which matters for host-local datastores.
+func (k *vSphereDeployment) diskDatastores(ctx context.Context, finder *find.Finder) ([]types.ManagedObjectReference, error) {
+	var refs []types.ManagedObjectReference
+	for _, d := range k.Disks {
+		if d.Datastore == "" {
+			continue
+		}
+		ds, err := finder.Datastore(ctx, d.Datastore)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find datastore '%s': %w", d.Datastore, err)
+		}
+		if !slices.Contains(refs, ds.Reference()) {
+			refs = append(refs, ds.Reference())
+		}
+	}
+	return refs, nil
+}
+
+// vmDatastoreDiskBytes returns the size of the configured disks that are
+// placed on the instance's own datastore.
+func (k *vSphereDeployment) vmDatastoreDiskBytes() int64 {
+	var size int64
+	for _, d := range k.Disks {
+		if d.Datastore == "" {
+			size += gigabytes(d.SizeGB)
+		}
+	}
+	return size
+}
+
+func gigabytes(n int64) int64 {
+	return n * 1024 * 1024 * 1024
+}
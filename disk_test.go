@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/vmware/govmomi/find"
+	"github.com/vmware/govmomi/vim25/types"
+	"gitlab.com/gitlab-org/fleeting/fleeting/provider"
+)
+
+func TestDiskConfigValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		disk    diskConfig
+		wantErr bool
+	}{
+		{"defaults", diskConfig{SizeGB: 10}, false},
+		{"eager zeroed nvme", diskConfig{SizeGB: 10, Provisioning: diskProvisioningEagerZeroed, Controller: diskControllerNVMe}, false},
+		{"no size", diskConfig{}, true},
+		{"invalid provisioning", diskConfig{SizeGB: 10, Provisioning: "lazy"}, true},
+		{"invalid controller", diskConfig{SizeGB: 10, Controller: "ide"}, true},
+		{"scratch", diskConfig{SizeGB: 10, Datastore: "local-nvme", Mode: "independent_nonpersistent"}, false},
+		{"invalid mode", diskConfig{SizeGB: 10, Mode: "undoable"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.disk.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestVSphereDeployment_InitRecycleIndependentDisks(t *testing.T) {
+	withTestVSphere(t, func(ctx context.Context, deployment *vSphereDeployment) {
+		deployment.WarmPoolSize = 1
+		deployment.Recycle = true
+		deployment.Disks = []diskConfig{{SizeGB: 5, Mode: "independent_persistent"}}
+
+		_, err := deployment.Init(ctx, nil, provider.Settings{})
+		if err == nil || !strings.Contains(err.Error(), "not supported with recycle") {
+			t.Errorf("Expected independent persistent disks to be rejected with recycle, got %v", err)
+		}
+	})
+}
+
+func TestVSphereDeployment_Disks(t *testing.T) {
+	withTestVSphere(t, func(ctx context.Context, deployment *vSphereDeployment) {
+		deployment.DiskSizeGB = 20
+		deployment.Disks = []diskConfig{
+			{SizeGB: 50, Provisioning: diskProvisioningThick},
+			{SizeGB: 5, Provisioning: diskProvisioningEagerZeroed, Datastore: "LocalDS_0", Mode: "independent_nonpersistent"},
+		}
+
+		if n, err := deployment.Increase(ctx, 1); err != nil || n != 1 {
+			t.Fatalf("Increase() = %d, %v", n, err)
+		}
+
+		vms, err := deployment.listVMs(ctx, []string{"name"})
+		if err != nil {
+			t.Fatalf("listVMs() failed: %v", err)
+		}
+		var instance string
+		for _, vm := range vms {
+			if isInstanceName(deployment.Prefix, vm.Name) {
+				instance = vm.Name
+			}
+		}
+
+		finder := find.NewFinder(deployment.client.Client, true)
+		dc, err := finder.Datacenter(ctx, "DC0")
+		if err != nil {
+			t.Fatalf("Could not find datacenter: %v", err)
+		}
+		finder.SetDatacenter(dc)
+
+		vm, err := finder.VirtualMachine(ctx, deployment.Folder+instance)
+		if err != nil {
+			t.Fatalf("Could not find instance: %v", err)
+		}
+		devices, err := vm.Device(ctx)
+		if err != nil {
+			t.Fatalf("Device() failed: %v", err)
+		}
+
+		disks := devices.SelectByType((*types.VirtualDisk)(nil))
+		if len(disks) != 3 {
+			t.Fatalf("Expected 3 disks, got %d", len(disks))
+		}
+		want := []int64{20, 50, 5}
+		for i, device := range disks {
+			disk := device.(*types.VirtualDisk)
+			if disk.CapacityInBytes != gigabytes(want[i]) {
+				t.Errorf("Expected disk %d to have %d GB, got %d bytes", i, want[i], disk.CapacityInBytes)
+			}
+		}
+		backing := disks[1].(*types.VirtualDisk).Backing.(*types.VirtualDiskFlatVer2BackingInfo)
+		if backing.ThinProvisioned == nil || *backing.ThinProvisioned {
+			t.Error("Expected thick provisioned data disk")
+		}
+		scratch := disks[2].(*types.VirtualDisk).Backing.(*types.VirtualDiskFlatVer2BackingInfo)
+		if scratch.DiskMode != string(types.VirtualDiskModeIndependent_nonpersistent) {
+			t.Errorf("Expected independent nonpersistent scratch disk, got %s", scratch.DiskMode)
+		}
+	})
+}
+
+func TestVSphereDeployment_DiskSizeSmallerThanTemplate(t *testing.T) {
+	withTestVSphere(t, func(ctx context.Context, deployment *vSphereDeployment) {
+		finder := find.NewFinder(deployment.client.Client, true)
+		dc, err := finder.Datacenter(ctx, "DC0")
+		if err != nil {
+			t.Fatalf("Could not find datacenter: %v", err)
+		}
+		finder.SetDatacenter(dc)
+		template, err := finder.VirtualMachine(ctx, deployment.Template)
+		if err != nil {
+			t.Fatalf("Could not find template: %v", err)
+		}
+
+		// The simulator's template disk is 10 GB.
+		deployment.DiskSizeGB = 1
+		if _, err := deployment.diskChanges(ctx, finder, template); err == nil {
+			t.Error("Expected shrinking the template's disk to fail")
+		}
+	})
+}
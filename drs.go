@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	"github.com/vmware/govmomi/find"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// drsRuleName returns the name of the VM-host rule tying the VM group to
+// the host group.
+func (k *vSphereDeployment) drsRuleName() string {
+	if k.DRSRule != "" {
+		return k.DRSRule
+	}
+	return fmt.Sprintf("%s-on-%s", k.DRSVMGroup, k.DRSHostGroup)
+}
+
+// ensureDRSRule creates the DRS VM group and the VM-host rule that keeps the
+// group on the host group, unless they exist already. The host group has to
+// exist.
+func (k *vSphereDeployment) ensureDRSRule(ctx context.Context, finder *find.Finder) error {
+	k.drsMu.Lock()
+	defer k.drsMu.Unlock()
+
+	cluster, err := finder.ClusterComputeResource(ctx, k.Cluster)
+	if err != nil {
+		return fmt.Errorf("failed to find cluster: %v", err)
+	}
+	config, err := cluster.Configuration(ctx)
+	if err != nil {
+		return err
+	}
+
+	var spec types.ClusterConfigSpecEx
+	var hasHostGroup bool
+	var hasVMGroup bool
+	for _, group := range config.Group {
+		switch group := group.(type) {
+		case *types.ClusterHostGroup:
+			hasHostGroup = hasHostGroup || group.Name == k.DRSHostGroup
+		case *types.ClusterVmGroup:
+			hasVMGroup = hasVMGroup || group.Name == k.DRSVMGroup
+		}
+	}
+	if !hasHostGroup {
+		return fmt.Errorf("DRS host group '%s' not found in cluster '%s'", k.DRSHostGroup, k.Cluster)
+	}
+	if !hasVMGroup {
+		spec.GroupSpec = append(spec.GroupSpec, types.ClusterGroupSpec{
+			ArrayUpdateSpec: types.ArrayUpdateSpec{Operation: types.ArrayUpdateOperationAdd},
+			Info: &types.ClusterVmGroup{
+				ClusterGroupInfo: types.ClusterGroupInfo{Name: k.DRSVMGroup},
+			},
+		})
+	}
+
+	name := k.drsRuleName()
+	if !slices.ContainsFunc(config.Rule, func(rule types.BaseClusterRuleInfo) bool {
+		return rule.GetClusterRuleInfo().Name == name
+	}) {
+		enabled := true
+		mandatory := k.DRSRuleMandatory
+		spec.RulesSpec = append(spec.RulesSpec, types.ClusterRuleSpec{
+			ArrayUpdateSpec: types.ArrayUpdateSpec{Operation: types.ArrayUpdateOperationAdd},
+			Info: &types.ClusterVmHostRuleInfo{
+				ClusterRuleInfo: types.ClusterRuleInfo{
+					Name:      name,
+					Enabled:   &enabled,
+					Mandatory: &mandatory,
+				},
+				VmGroupName:         k.DRSVMGroup,
+				AffineHostGroupName: k.DRSHostGroup,
+			},
+		})
+	}
+
+	if len(spec.GroupSpec) == 0 && len(spec.RulesSpec) == 0 {
+		return nil
+	}
+
+	k.logger().Info("creating DRS VM group and rule", "cluster", k.Cluster, "vm_group", k.DRSVMGroup, "rule", name)
+	return reconfigureCluster(ctx, cluster, &spec)
+}
+
+// updateDRSGroup adds and removes the named instances to and from the DRS VM
+// group. Instances that cannot be found are ignored.
+func (k *vSphereDeployment) updateDRSGroup(ctx context.Context, finder *find.Finder, add []string, remove []string) error {
+	k.drsMu.Lock()
+	defer k.drsMu.Unlock()
+
+	cluster, err := finder.ClusterComputeResource(ctx, k.Cluster)
+	if err != nil {
+		return fmt.Errorf("failed to find cluster: %v", err)
+	}
+	config, err := cluster.Configuration(ctx)
+	if err != nil {
+		return err
+	}
+
+	var group *types.ClusterVmGroup
+	for _, g := range config.Group {
+		if g, ok := g.(*types.ClusterVmGroup); ok && g.Name == k.DRSVMGroup {
+			group = g
+		}
+	}
+	if group == nil {
+		return fmt.Errorf("DRS VM group '%s' not found in cluster '%s'", k.DRSVMGroup, k.Cluster)
+	}
+
+	vms := slices.Clone(group.Vm)
+	for _, name := range remove {
+		vm, err := finder.VirtualMachine(ctx, k.Folder+name)
+		if err != nil {
+			continue
+		}
+		vms = slices.DeleteFunc(vms, func(ref types.ManagedObjectReference) bool {
+			return ref == vm.Reference()
+		})
+	}
+	for _, name := range add {
+		vm, err := finder.VirtualMachine(ctx, k.Folder+name)
+		if err != nil {
+			continue
+		}
+		if !slices.Contains(vms, vm.Reference()) {
+			vms = append(vms, vm.Reference())
+		}
+	}
+
+	return reconfigureCluster(ctx, cluster, &types.ClusterConfigSpecEx{
+		GroupSpec: []types.ClusterGroupSpec{{
+			ArrayUpdateSpec: types.ArrayUpdateSpec{Operation: types.ArrayUpdateOperationEdit},
+			Info: &types.ClusterVmGroup{
+				ClusterGroupInfo: types.ClusterGroupInfo{Name: k.DRSVMGroup},
+				Vm:               vms,
+			},
+		}},
+	})
+}
+
+func reconfigureCluster(ctx context.Context, cluster *object.ClusterComputeResource, spec *types.ClusterConfigSpecEx) error {
+	task, err := cluster.Reconfigure(ctx, spec, true)
+	if err != nil {
+		return fmt.Errorf("failed to reconfigure cluster: %v", err)
+	}
+	if err := task.Wait(ctx); err != nil {
+		return fmt.Errorf("cluster reconfigure task failed: %v", err)
+	}
+	return nil
+}
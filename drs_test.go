@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/vmware/govmomi/find"
+	"github.com/vmware/govmomi/vim25/types"
+	"gitlab.com/gitlab-org/fleeting/fleeting/provider"
+)
+
+func TestVSphereDeployment_DRSGroup(t *testing.T) {
+	withTestVSphere(t, func(ctx context.Context, deployment *vSphereDeployment) {
+		finder := find.NewFinder(deployment.client.Client, true)
+		dc, err := finder.Datacenter(ctx, "DC0")
+		if err != nil {
+			t.Fatalf("Could not find datacenter: %v", err)
+		}
+		finder.SetDatacenter(dc)
+
+		cluster, err := finder.ClusterComputeResource(ctx, "DC0_C0")
+		if err != nil {
+			t.Fatalf("Could not find cluster: %v", err)
+		}
+		err = reconfigureCluster(ctx, cluster, &types.ClusterConfigSpecEx{
+			GroupSpec: []types.ClusterGroupSpec{{
+				ArrayUpdateSpec: types.ArrayUpdateSpec{Operation: types.ArrayUpdateOperationAdd},
+				Info: &types.ClusterHostGroup{
+					ClusterGroupInfo: types.ClusterGroupInfo{Name: "licensed-hosts"},
+				},
+			}},
+		})
+		if err != nil {
+			t.Fatalf("Could not create host group: %v", err)
+		}
+
+		deployment.DRSVMGroup = "runners"
+		deployment.DRSHostGroup = "licensed-hosts"
+		if _, err := deployment.Init(ctx, nil, provider.Settings{}); err != nil {
+			t.Fatalf("Init() failed: %v", err)
+		}
+
+		groupVMs := func() []types.ManagedObjectReference {
+			config, err := cluster.Configuration(ctx)
+			if err != nil {
+				t.Fatalf("Could not get cluster configuration: %v", err)
+			}
+			var rule bool
+			for _, r := range config.Rule {
+				if r, ok := r.(*types.ClusterVmHostRuleInfo); ok && r.VmGroupName == "runners" && r.AffineHostGroupName == "licensed-hosts" {
+					rule = true
+				}
+			}
+			if !rule {
+				t.Fatal("Expected VM-host rule to exist")
+			}
+			for _, g := range config.Group {
+				if g, ok := g.(*types.ClusterVmGroup); ok && g.Name == "runners" {
+					return g.Vm
+				}
+			}
+			t.Fatal("Expected VM group to exist")
+			return nil
+		}
+
+		if _, err := deployment.Increase(ctx, 1); err != nil {
+			t.Fatalf("Increase() failed: %v", err)
+		}
+		if vms := groupVMs(); len(vms) != 1 {
+			t.Fatalf("Expected 1 VM in the group, got %d", len(vms))
+		}
+
+		vms, err := finder.VirtualMachineList(ctx, "/DC0/vm/test-vm-*")
+		if err != nil {
+			t.Fatalf("Could not list VMs: %v", err)
+		}
+		if _, err := deployment.Decrease(ctx, []string{vms[0].Name()}); err != nil {
+			t.Fatalf("Decrease() failed: %v", err)
+		}
+		if vms := groupVMs(); len(vms) != 0 {
+			t.Errorf("Expected the group to be empty, got %d VMs", len(vms))
+		}
+	})
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// extraConfigDenylist holds the extraConfig keys extra_config must not set,
+// matched case-insensitively. Entries ending in "." deny every key with that
+// prefix.
+var extraConfigDenylist = []string{
+	// Keys managed by the plugin itself.
+	"fleeting.",
+	// The VM's identity; duplicates confuse vCenter and the guest.
+	"uuid.bios",
+	"uuid.location",
+	"vc.uuid",
+	// File locations, which could point outside the VM's directory.
+	"checkpoint.",
+	"fileSearchPath",
+	"log.",
+	"nvram",
+	"suspend.directory",
+	"workingDir",
+	// Hypervisor internals that weaken the isolation from the host.
+	"isolation.",
+	"monitor.",
+	"monitor_control.",
+	// Remote console access bypassing vCenter.
+	"RemoteDisplay.",
+	// Host USB devices.
+	"usb.",
+	// Resource allocation, covered by the hardware profile.
+	"sched.",
+}
+
+// extraConfigDeniedPatterns holds patterns of extraConfig keys extra_config
+// must not set, matched against the lower-cased key: device backings, which
+// could attach arbitrary files or host devices, and NICs, which could be
+// rewired to other networks or given spoofed MAC addresses.
+var extraConfigDeniedPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`^(ide|nvme|sata|scsi)\d+:\d+\.filename$`),
+	regexp.MustCompile(`^floppy\d+\.filename$`),
+	regexp.MustCompile(`^(ethernet|parallel|pcipassthru|serial)\d+\.`),
+}
+
+// validateExtraConfig checks that no key in extraConfig is denied.
+func validateExtraConfig(extraConfig map[string]string) error {
+	for key := range extraConfig {
+		if key == "" {
+			return fmt.Errorf("keys must not be empty")
+		}
+		if extraConfigDenied(key) {
+			return fmt.Errorf("key %s may not be set", key)
+		}
+	}
+	return nil
+}
+
+// extraConfigDenied reports whether key matches the denylist or one of the
+// denied patterns.
+func extraConfigDenied(key string) bool {
+	key = strings.ToLower(key)
+	for _, denied := range extraConfigDenylist {
+		denied = strings.ToLower(denied)
+		if key == denied || strings.HasSuffix(denied, ".") && strings.HasPrefix(key, denied) {
+			return true
+		}
+	}
+	for _, pattern := range extraConfigDeniedPatterns {
+		if pattern.MatchString(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// extraConfigOptions returns extraConfig as option values, sorted by key.
+func extraConfigOptions(extraConfig map[string]string) []types.BaseOptionValue {
+	keys := make([]string, 0, len(extraConfig))
+	for key := range extraConfig {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	var options []types.BaseOptionValue
+	for _, key := range keys {
+		options = append(options, &types.OptionValue{Key: key, Value: extraConfig[key]})
+	}
+	return options
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/vmware/govmomi/find"
+)
+
+func TestValidateExtraConfig(t *testing.T) {
+	tests := []struct {
+		name        string
+		extraConfig map[string]string
+		wantErr     bool
+	}{
+		{"none", nil, false},
+		{"allowed", map[string]string{"disk.EnableUUID": "TRUE", "guestinfo.role": "runner", "tools.syncTime": "FALSE"}, false},
+		{"plugin key", map[string]string{"fleeting.uses": "0"}, true},
+		{"identity", map[string]string{"uuid.bios": "42 00"}, true},
+		{"case insensitive", map[string]string{"WorkingDir": "/vmfs/volumes/other"}, true},
+		{"prefix", map[string]string{"monitor_control.restrict_backdoor": "FALSE"}, true},
+		{"similar name", map[string]string{"logging": "TRUE"}, false},
+		{"scsi backing", map[string]string{"scsi0:1.fileName": "/vmfs/volumes/other/disk.vmdk"}, true},
+		{"sata backing", map[string]string{"sata0:0.fileName": "/vmfs/volumes/other/disk.iso"}, true},
+		{"nvme backing", map[string]string{"nvme0:0.fileName": "/vmfs/volumes/other/disk.vmdk"}, true},
+		{"ide backing", map[string]string{"IDE1:0.FILENAME": "/vmfs/volumes/other/disk.iso"}, true},
+		{"device option", map[string]string{"scsi0:1.redo": ""}, false},
+		{"serial port", map[string]string{"serial0.fileType": "pipe"}, true},
+		{"parallel port", map[string]string{"parallel1.fileName": "/dev/parport0"}, true},
+		{"nvram", map[string]string{"nvram": "/vmfs/volumes/other/vm.nvram"}, true},
+		{"remote display", map[string]string{"RemoteDisplay.vnc.enabled": "TRUE"}, true},
+		{"isolation", map[string]string{"isolation.tools.copy.disable": "FALSE"}, true},
+		{"floppy backing", map[string]string{"floppy0.fileName": "/vmfs/volumes/other/disk.flp"}, true},
+		{"nic network", map[string]string{"ethernet0.networkName": "Production"}, true},
+		{"nic address", map[string]string{"ethernet1.address": "00:50:56:00:00:01"}, true},
+		{"nic connection type", map[string]string{"Ethernet0.connectionType": "bridged"}, true},
+		{"pci passthrough", map[string]string{"pciPassthru0.id": "0000:3b:00.0"}, true},
+		{"host usb", map[string]string{"usb.autoConnect.device0": "vid:0x0781"}, true},
+		{"empty key", map[string]string{"": "TRUE"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateExtraConfig(tt.extraConfig); (err != nil) != tt.wantErr {
+				t.Errorf("validateExtraConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestVSphereDeployment_CloneConfigExtraConfig(t *testing.T) {
+	withTestVSphere(t, func(ctx context.Context, deployment *vSphereDeployment) {
+		deployment.ExtraConfig = map[string]string{
+			"tools.syncTime":  "FALSE",
+			"disk.EnableUUID": "TRUE",
+		}
+		deployment.Profiles = map[string]instanceProfile{"small": {}}
+
+		finder := find.NewFinder(deployment.client.Client, true)
+		dc, err := finder.Datacenter(ctx, "DC0")
+		if err != nil {
+			t.Fatalf("Failed to find datacenter: %v", err)
+		}
+		finder.SetDatacenter(dc)
+		template, err := finder.VirtualMachine(ctx, deployment.Template)
+		if err != nil {
+			t.Fatalf("Failed to find template: %v", err)
+		}
+
+		config, err := deployment.cloneConfig(ctx, finder, template, deployment.profile("small"))
+		if err != nil {
+			t.Fatalf("cloneConfig() failed: %v", err)
+		}
+
+		want := []string{"disk.EnableUUID=TRUE", "tools.syncTime=FALSE", profileKey + "=small"}
+		if len(config.ExtraConfig) != len(want) {
+			t.Fatalf("Expected %d extraConfig options, got %d", len(want), len(config.ExtraConfig))
+		}
+		for i, opt := range config.ExtraConfig {
+			o := opt.GetOptionValue()
+			if got := o.Key + "=" + o.Value.(string); got != want[i] {
+				t.Errorf("Expected option %d to be %s, got %s", i, want[i], got)
+			}
+		}
+	})
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/vmware/govmomi/find"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// cloneConfig returns the configuration applied to full and linked clones of
+// profile on top of the CPU and memory size: the hardware profile, disk
+// changes, security options, extra_config and the profile name.
+func (k *vSphereDeployment) cloneConfig(ctx context.Context, finder *find.Finder, srcVM *object.VirtualMachine, profile instanceProfile) (types.VirtualMachineConfigSpec, error) {
+	var config types.VirtualMachineConfigSpec
+	if err := k.hardwareConfig(&config, profile.Cpu); err != nil {
+		return types.VirtualMachineConfigSpec{}, err
+	}
+
+	deviceChange, err := k.diskChanges(ctx, finder, srcVM)
+	if err != nil {
+		return types.VirtualMachineConfigSpec{}, err
+	}
+	config.DeviceChange = deviceChange
+
+	if err := k.securityConfig(ctx, srcVM, &config); err != nil {
+		return types.VirtualMachineConfigSpec{}, err
+	}
+
+	config.ExtraConfig = extraConfigOptions(k.ExtraConfig)
+	if profile.name != "" {
+		config.ExtraConfig = append(config.ExtraConfig, &types.OptionValue{Key: profileKey, Value: profile.name})
+	}
+
+	return config, nil
+}
+
+// hasHardwareProfile reports whether any hardware profile option is set.
+func (k *vSphereDeployment) hasHardwareProfile() bool {
+	return k.CoresPerSocket != 0 || k.CPUHotAdd || k.MemoryHotAdd ||
+		k.CPUReservationMHz != 0 || k.CPULimitMHz != 0 || k.CPUShares != "" ||
+		k.MemoryReservationMB != 0 || k.MemoryLimitMB != 0 || k.MemoryShares != "" ||
+		k.LatencySensitivity != "" || k.NestedHV
+}
+
+// hardwareConfig applies the hardware profile to spec for clones with cpu
+// virtual CPUs.
+func (k *vSphereDeployment) hardwareConfig(spec *types.VirtualMachineConfigSpec, cpu string) error {
+	if k.CoresPerSocket < 0 {
+		return fmt.Errorf("cores_per_socket must not be negative")
+	}
+	if k.CoresPerSocket > 0 {
+		cpuCount, err := strconv.ParseInt(cpu, 10, 32)
+		if err != nil {
+			return fmt.Errorf("invalid CPU count: %v", err)
+		}
+		if cpuCount%int64(k.CoresPerSocket) != 0 {
+			return fmt.Errorf("cpu %d is not a multiple of cores_per_socket %d", cpuCount, k.CoresPerSocket)
+		}
+		spec.NumCoresPerSocket = int32(k.CoresPerSocket)
+	}
+
+	if k.CPUHotAdd {
+		spec.CpuHotAddEnabled = types.NewBool(true)
+	}
+	if k.MemoryHotAdd {
+		spec.MemoryHotAddEnabled = types.NewBool(true)
+	}
+	if k.NestedHV {
+		spec.NestedHVEnabled = types.NewBool(true)
+	}
+
+	cpuAllocation, err := resourceAllocation(k.CPUReservationMHz, k.CPULimitMHz, k.CPUShares)
+	if err != nil {
+		return fmt.Errorf("invalid CPU allocation: %w", err)
+	}
+	spec.CpuAllocation = cpuAllocation
+
+	memoryAllocation, err := resourceAllocation(k.MemoryReservationMB, k.MemoryLimitMB, k.MemoryShares)
+	if err != nil {
+		return fmt.Errorf("invalid memory allocation: %w", err)
+	}
+	spec.MemoryAllocation = memoryAllocation
+
+	switch level := types.LatencySensitivitySensitivityLevel(k.LatencySensitivity); level {
+	case "":
+	case types.LatencySensitivitySensitivityLevelLow, types.LatencySensitivitySensitivityLevelNormal,
+		types.LatencySensitivitySensitivityLevelMedium, types.LatencySensitivitySensitivityLevelHigh:
+		spec.LatencySensitivity = &types.LatencySensitivity{Level: level}
+	default:
+		return fmt.Errorf("unsupported latency_sensitivity: %s", k.LatencySensitivity)
+	}
+
+	return nil
+}
+
+// resourceAllocation returns the allocation for the given reservation, limit
+// and shares, or nil if none of them is set. Reservations and limits are in
+// MHz for CPU and MB for memory.
+func resourceAllocation(reservation int64, limit int64, shares string) (*types.ResourceAllocationInfo, error) {
+	if reservation == 0 && limit == 0 && shares == "" {
+		return nil, nil
+	}
+	if reservation < 0 {
+		return nil, fmt.Errorf("reservation must not be negative")
+	}
+	if limit < 0 {
+		return nil, fmt.Errorf("limit must not be negative")
+	}
+	if limit > 0 && reservation > limit {
+		return nil, fmt.Errorf("reservation %d exceeds limit %d", reservation, limit)
+	}
+
+	allocation := &types.ResourceAllocationInfo{}
+	if reservation > 0 {
+		allocation.Reservation = types.NewInt64(reservation)
+	}
+	if limit > 0 {
+		allocation.Limit = types.NewInt64(limit)
+	}
+	if shares != "" {
+		info, err := parseShares(shares)
+		if err != nil {
+			return nil, err
+		}
+		allocation.Shares = info
+	}
+	return allocation, nil
+}
+
+// parseShares parses a shares level, "low", "normal" or "high", or a custom
+// number of shares.
+func parseShares(shares string) (*types.SharesInfo, error) {
+	switch level := types.SharesLevel(shares); level {
+	case types.SharesLevelLow, types.SharesLevelNormal, types.SharesLevelHigh:
+		return &types.SharesInfo{Level: level}, nil
+	}
+
+	n, err := strconv.ParseInt(shares, 10, 32)
+	if err != nil || n <= 0 {
+		return nil, fmt.Errorf("shares must be low, normal, high or a positive number: %s", shares)
+	}
+	return &types.SharesInfo{Level: types.SharesLevelCustom, Shares: int32(n)}, nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+func TestParseShares(t *testing.T) {
+	tests := []struct {
+		shares  string
+		want    types.SharesInfo
+		wantErr bool
+	}{
+		{"high", types.SharesInfo{Level: types.SharesLevelHigh}, false},
+		{"2000", types.SharesInfo{Level: types.SharesLevelCustom, Shares: 2000}, false},
+		{"0", types.SharesInfo{}, true},
+		{"plenty", types.SharesInfo{}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.shares, func(t *testing.T) {
+			got, err := parseShares(tt.shares)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseShares() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && *got != tt.want {
+				t.Errorf("parseShares() = %+v, want %+v", *got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVSphereDeployment_HardwareConfig(t *testing.T) {
+	tests := []struct {
+		name       string
+		deployment *vSphereDeployment
+		wantErr    bool
+	}{
+		{"empty", &vSphereDeployment{Cpu: "4"}, false},
+		{"cores per socket", &vSphereDeployment{Cpu: "4", CoresPerSocket: 2}, false},
+		{"cores not dividing cpu", &vSphereDeployment{Cpu: "4", CoresPerSocket: 3}, true},
+		{"reservation above limit", &vSphereDeployment{Cpu: "4", CPUReservationMHz: 2000, CPULimitMHz: 1000}, true},
+		{"negative memory limit", &vSphereDeployment{Cpu: "4", MemoryLimitMB: -1}, true},
+		{"invalid shares", &vSphereDeployment{Cpu: "4", MemoryShares: "lots"}, true},
+		{"latency sensitivity", &vSphereDeployment{Cpu: "4", LatencySensitivity: "high"}, false},
+		{"invalid latency sensitivity", &vSphereDeployment{Cpu: "4", LatencySensitivity: "extreme"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var spec types.VirtualMachineConfigSpec
+			if err := tt.deployment.hardwareConfig(&spec, tt.deployment.Cpu); (err != nil) != tt.wantErr {
+				t.Errorf("hardwareConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestVSphereDeployment_HardwareConfigSpec(t *testing.T) {
+	deployment := &vSphereDeployment{
+		Cpu:                 "4",
+		CoresPerSocket:      2,
+		NestedHV:            true,
+		CPUHotAdd:           true,
+		MemoryReservationMB: 512,
+		CPUShares:           "high",
+		LatencySensitivity:  "high",
+	}
+
+	var spec types.VirtualMachineConfigSpec
+	if err := deployment.hardwareConfig(&spec, deployment.Cpu); err != nil {
+		t.Fatalf("hardwareConfig() failed: %v", err)
+	}
+
+	if spec.NumCoresPerSocket != 2 {
+		t.Errorf("Expected 2 cores per socket, got %d", spec.NumCoresPerSocket)
+	}
+	if spec.NestedHVEnabled == nil || !*spec.NestedHVEnabled {
+		t.Error("Expected nested hardware virtualization to be enabled")
+	}
+	if spec.CpuHotAddEnabled == nil || !*spec.CpuHotAddEnabled {
+		t.Error("Expected CPU hot-add to be enabled")
+	}
+	if spec.MemoryHotAddEnabled != nil {
+		t.Error("Expected memory hot-add to be left alone")
+	}
+	if a := spec.MemoryAllocation; a == nil || a.Reservation == nil || *a.Reservation != 512 || a.Limit != nil {
+		t.Errorf("Expected a memory reservation of 512 MB without limit, got %+v", a)
+	}
+	if a := spec.CpuAllocation; a == nil || a.Shares == nil || a.Shares.Level != types.SharesLevelHigh || a.Reservation != nil {
+		t.Errorf("Expected high CPU shares without reservation, got %+v", a)
+	}
+	if spec.LatencySensitivity == nil || spec.LatencySensitivity.Level != types.LatencySensitivitySensitivityLevelHigh {
+		t.Errorf("Expected high latency sensitivity, got %+v", spec.LatencySensitivity)
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/vmware/govmomi/find"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/property"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// instantCloneIdentity holds the changes applied to an instant clone so it
+// does not share the parent's network identity.
+type instantCloneIdentity struct {
+	extraConfig  []types.BaseOptionValue
+	deviceChange []types.BaseVirtualDeviceConfigSpec
+}
+
+// instantCloneIdentity returns the identity changes for the instant clone
+// vmName of parent: new MAC addresses for every NIC if instant_clone_new_mac
+// is set, and the instant_clone_guestinfo keys with "{name}" replaced by the
+// instance name.
+func (k *vSphereDeployment) instantCloneIdentity(ctx context.Context, parent *object.VirtualMachine, vmName string) (instantCloneIdentity, error) {
+	var identity instantCloneIdentity
+
+	keys := make([]string, 0, len(k.InstantCloneGuestinfo))
+	for key := range k.InstantCloneGuestinfo {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	for _, key := range keys {
+		identity.extraConfig = append(identity.extraConfig, &types.OptionValue{
+			Key:   key,
+			Value: strings.ReplaceAll(k.InstantCloneGuestinfo[key], "{name}", vmName),
+		})
+	}
+
+	if k.InstantCloneNewMAC {
+		devices, err := parent.Device(ctx)
+		if err != nil {
+			return instantCloneIdentity{}, fmt.Errorf("failed to get parent devices: %w", err)
+		}
+		identity.deviceChange = newMACs(devices)
+	}
+
+	return identity, nil
+}
+
+// newMACs returns device changes that let vCenter generate a new MAC address
+// for every NIC in devices.
+func newMACs(devices object.VirtualDeviceList) []types.BaseVirtualDeviceConfigSpec {
+	var changes []types.BaseVirtualDeviceConfigSpec
+	for _, device := range devices.SelectByType((*types.VirtualEthernetCard)(nil)) {
+		card := device.(types.BaseVirtualEthernetCard).GetVirtualEthernetCard()
+		card.AddressType = string(types.VirtualEthernetCardMacTypeGenerated)
+		card.MacAddress = ""
+		changes = append(changes, &types.VirtualDeviceConfigSpec{
+			Operation: types.VirtualDeviceConfigSpecOperationEdit,
+			Device:    device,
+		})
+	}
+	return changes
+}
+
+// parentAddressesKey is the extraConfig key recording the addresses an
+// instant clone parent had before it was frozen, as a frozen parent reports
+// no guest network information.
+const parentAddressesKey = "fleeting.parentAddresses"
+
+// waitDistinctAddress waits until the instance vmName reports a primary
+// address matching the address policy that neither parent nor any other
+// instance has, bounded by the creation timeout. The address is claimed for
+// vmName until it is no longer in flight.
+func (k *vSphereDeployment) waitDistinctAddress(ctx context.Context, finder *find.Finder, parent *object.VirtualMachine, vmName string) error {
+	var parentInfo mo.VirtualMachine
+	if err := parent.Properties(ctx, parent.Reference(), []string{"guest", "config.extraConfig"}, &parentInfo); err != nil {
+		return err
+	}
+	parentAddrs := k.addresses.addresses(parentInfo.Guest)
+	parentAddrs = append(parentAddrs, recordedParentAddresses(parentInfo)...)
+
+	vm, err := finder.VirtualMachine(ctx, k.Folder+vmName)
+	if err != nil {
+		return fmt.Errorf("error finding VM %s: %w", vmName, err)
+	}
+
+	if k.creationTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, k.creationTimeout)
+		defer cancel()
+	}
+
+	var claimErr error
+	err = property.Wait(ctx, property.DefaultCollector(k.client.Client), vm.Reference(), []string{"guest"}, func(changes []types.PropertyChange) bool {
+		for _, change := range changes {
+			guest, ok := change.Val.(types.GuestInfo)
+			if !ok {
+				continue
+			}
+			addr := k.addresses.primary(&guest)
+			if addr == "" || slices.Contains(parentAddrs, addr) {
+				continue
+			}
+			claimed, err := k.claimAddress(ctx, vmName, addr)
+			if err != nil {
+				claimErr = err
+				return true
+			}
+			if claimed {
+				return true
+			}
+			k.logger().Warn("instant clone reported an address already in use", "instance", vmName, "address", addr)
+		}
+		return false
+	})
+	if err == nil {
+		err = claimErr
+	}
+	if err != nil {
+		return fmt.Errorf("waiting for instant clone %s to report an address distinct from its parent and other instances: %w", vmName, err)
+	}
+	return nil
+}
+
+// claimAddress claims addr for the instant clone vmName unless another
+// instance already uses or claimed it.
+func (k *vSphereDeployment) claimAddress(ctx context.Context, vmName string, addr string) (bool, error) {
+	k.addressMu.Lock()
+	defer k.addressMu.Unlock()
+
+	vms, err := k.listVMs(ctx, []string{"name", "guest"})
+	if err != nil {
+		return false, err
+	}
+	if k.takenAddresses(vms, vmName)[addr] {
+		return false, nil
+	}
+
+	if k.claimed == nil {
+		k.claimed = make(map[string]string)
+	}
+	k.claimed[vmName] = addr
+	return true, nil
+}
+
+// takenAddresses returns the addresses used by instances other than self:
+// those of instances that were fully created and those claimed by instant
+// clones still in flight. k.addressMu must be held.
+func (k *vSphereDeployment) takenAddresses(vms []mo.VirtualMachine, self string) map[string]bool {
+	taken := make(map[string]bool)
+	for _, vm := range vms {
+		if vm.Name == self || !k.isInstance(vm.Name) || k.isInflight(vm.Name) {
+			continue
+		}
+		for _, addr := range k.addresses.addresses(vm.Guest) {
+			taken[addr] = true
+		}
+	}
+	for name, addr := range k.claimed {
+		if name != self {
+			taken[addr] = true
+		}
+	}
+	return taken
+}
+
+// releaseAddress forgets the address claimed by vmName.
+func (k *vSphereDeployment) releaseAddress(vmName string) {
+	k.addressMu.Lock()
+	defer k.addressMu.Unlock()
+
+	delete(k.claimed, vmName)
+}
+
+// recordedParentAddresses returns the addresses recorded in the parent's
+// extraConfig before it was frozen.
+func recordedParentAddresses(parent mo.VirtualMachine) []string {
+	if parent.Config == nil {
+		return nil
+	}
+	for _, opt := range parent.Config.ExtraConfig {
+		o := opt.GetOptionValue()
+		if o.Key != parentAddressesKey {
+			continue
+		}
+		value, _ := o.Value.(string)
+		if value == "" {
+			return nil
+		}
+		return strings.Split(value, ",")
+	}
+	return nil
+}
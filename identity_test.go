@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"maps"
+	"slices"
+	"testing"
+
+	"github.com/vmware/govmomi/find"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+func TestVSphereDeployment_TakenAddresses(t *testing.T) {
+	guest := func(addr string) *types.GuestInfo {
+		return &types.GuestInfo{IpAddress: addr, Net: []types.GuestNicInfo{{
+			MacAddress: "00:50:56:00:00:01",
+			IpAddress:  []string{addr},
+			IpConfig:   &types.NetIpConfigInfo{},
+		}}}
+	}
+
+	deployment := &vSphereDeployment{
+		Prefix:   "test-vm",
+		inflight: map[string]struct{}{"test-vm-3": {}},
+		claimed:  map[string]string{"test-vm-4": "10.0.0.4", "test-vm-5": "10.0.0.5"},
+	}
+	vms := []mo.VirtualMachine{
+		{Guest: guest("10.0.0.1"), ManagedEntity: mo.ManagedEntity{Name: "test-vm-1"}},
+		{Guest: guest("10.0.0.2"), ManagedEntity: mo.ManagedEntity{Name: "other-vm"}},
+		{Guest: guest("10.0.0.3"), ManagedEntity: mo.ManagedEntity{Name: "test-vm-3"}},
+		{Guest: guest("10.0.0.5"), ManagedEntity: mo.ManagedEntity{Name: "test-vm-5"}},
+	}
+
+	taken := deployment.takenAddresses(vms, "test-vm-5")
+	want := map[string]bool{"10.0.0.1": true, "10.0.0.4": true}
+	if !maps.Equal(taken, want) {
+		t.Errorf("takenAddresses() = %v, want %v", taken, want)
+	}
+
+	// An instant clone that duplicates an existing instance's address, as
+	// happens when a clone keeps the parent's DHCP lease, must not be
+	// considered distinct.
+	if dup := deployment.addresses.primary(guest("10.0.0.1")); !taken[dup] {
+		t.Errorf("Expected the duplicate address %s to be taken", dup)
+	}
+}
+
+func TestRecordedParentAddresses(t *testing.T) {
+	parent := mo.VirtualMachine{Config: &types.VirtualMachineConfigInfo{
+		ExtraConfig: []types.BaseOptionValue{&types.OptionValue{Key: parentAddressesKey, Value: "10.0.0.1,fd00::1"}},
+	}}
+	if got := recordedParentAddresses(parent); !slices.Equal(got, []string{"10.0.0.1", "fd00::1"}) {
+		t.Errorf("recordedParentAddresses() = %v", got)
+	}
+	if got := recordedParentAddresses(mo.VirtualMachine{}); got != nil {
+		t.Errorf("Expected no addresses without config, got %v", got)
+	}
+}
+
+func TestVSphereDeployment_InstantCloneIdentity(t *testing.T) {
+	withTestVSphere(t, func(ctx context.Context, deployment *vSphereDeployment) {
+		deployment.InstantCloneNewMAC = true
+		deployment.InstantCloneGuestinfo = map[string]string{
+			"guestinfo.hostname": "{name}",
+			"guestinfo.dhcp":     "renew",
+		}
+
+		finder := find.NewFinder(deployment.client.Client, true)
+		dc, err := finder.Datacenter(ctx, "DC0")
+		if err != nil {
+			t.Fatalf("Could not find datacenter: %v", err)
+		}
+		finder.SetDatacenter(dc)
+
+		template, err := finder.VirtualMachine(ctx, deployment.Template)
+		if err != nil {
+			t.Fatalf("Could not find template: %v", err)
+		}
+
+		identity, err := deployment.instantCloneIdentity(ctx, template, "test-vm-1")
+		if err != nil {
+			t.Fatalf("instantCloneIdentity() failed: %v", err)
+		}
+
+		want := map[string]string{"guestinfo.hostname": "test-vm-1", "guestinfo.dhcp": "renew"}
+		if len(identity.extraConfig) != len(want) {
+			t.Fatalf("Expected %d guestinfo keys, got %d", len(want), len(identity.extraConfig))
+		}
+		for _, opt := range identity.extraConfig {
+			o := opt.GetOptionValue()
+			if o.Value != want[o.Key] {
+				t.Errorf("Expected %s = %q, got %q", o.Key, want[o.Key], o.Value)
+			}
+		}
+
+		if len(identity.deviceChange) == 0 {
+			t.Fatal("Expected device changes for the template's NICs")
+		}
+		for _, change := range identity.deviceChange {
+			spec := change.GetVirtualDeviceConfigSpec()
+			card, ok := spec.Device.(types.BaseVirtualEthernetCard)
+			if !ok {
+				t.Fatalf("Expected an ethernet card, got %T", spec.Device)
+			}
+			if c := card.GetVirtualEthernetCard(); c.AddressType != string(types.VirtualEthernetCardMacTypeGenerated) || c.MacAddress != "" {
+				t.Errorf("Expected a generated MAC address, got %s %q", c.AddressType, c.MacAddress)
+			}
+		}
+	})
+}
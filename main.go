@@ -2,8 +2,8 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"net"
 	"net/url"
 	"os"
 	"strconv"
@@ -16,6 +16,7 @@ import (
 	"github.com/vmware/govmomi"
 	"github.com/vmware/govmomi/find"
 	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/property"
 	"github.com/vmware/govmomi/vim25/methods"
 	"github.com/vmware/govmomi/vim25/mo"
 	"github.com/vmware/govmomi/vim25/types"
@@ -28,6 +29,57 @@ var _ provider.InstanceGroup = &vSphereDeployment{}
 type vSphereDeployment struct {
 	client   *govmomi.Client
 	settings provider.Settings
+	log      hclog.Logger
+
+	// inflight holds the names of instances that are still being deployed,
+	// so background work never acts on a half-created VM.
+	mu       sync.Mutex
+	inflight map[string]struct{}
+
+	// ready holds the instances that passed their readiness probes.
+	ready map[string]bool
+	// started holds the instances that were reported running at least once.
+	started map[string]bool
+	// destroying holds the timed out instances that are being destroyed.
+	destroying map[string]bool
+	// unreachable holds since when unreachable instances have been so.
+	unreachable map[string]time.Time
+
+	// nextDatastore is the round-robin position in Datastores.
+	nextDatastore int
+
+	// drsMu serializes edits of the DRS VM group.
+	drsMu sync.Mutex
+	// snapshotMu serializes management of the template snapshot.
+	snapshotMu sync.Mutex
+	// parentMu serializes preparation of instant clone parents.
+	parentMu sync.Mutex
+	// addressMu serializes claiming the addresses of new instant clones,
+	// claimed holds the address each instant clone still in flight claimed.
+	addressMu sync.Mutex
+	claimed   map[string]string
+	// poolMu serializes taking VMs from the warm pool.
+	poolMu sync.Mutex
+	// poolRefill triggers a warm pool refill.
+	poolRefill chan struct{}
+
+	// cancel stops the background goroutines started in Init, wg tracks them.
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	// tasks tracks Increase and Decrease calls so Shutdown can wait for
+	// in-flight clone and destroy tasks.
+	tasks sync.WaitGroup
+
+	addresses          addressPolicy
+	connectInfoTTL     time.Duration
+	credentialLifetime time.Duration
+	creationTimeout    time.Duration
+	unreachableTimeout time.Duration
+	reaperInterval     time.Duration
+	reaperMaxAge       time.Duration
+
+	warmPoolRefillInterval time.Duration
 
 	Vsphereurl     string
 	Deploytype     string
@@ -39,10 +91,87 @@ type vSphereDeployment struct {
 	Contentlibrary string
 	Network        string
 	Template       string
+	Snapshot       string
 	Folder         string
 	Cpu            string
 	Memory         string
 	Prefix         string
+
+	CreationTimeout    string `json:"creation_timeout"`
+	UnreachableTimeout string `json:"unreachable_timeout"`
+	ReaperInterval     string `json:"reaper_interval"`
+	ReaperMaxAge       string `json:"reaper_max_age"`
+	ReaperDryRun       bool   `json:"reaper_dry_run"`
+
+	DeleteOnShutdown bool `json:"delete_on_shutdown"`
+
+	ReadinessTCPPort   int    `json:"readiness_tcp_port"`
+	ReadinessGuestinfo string `json:"readiness_guestinfo"`
+	ReadinessFile      string `json:"readiness_file"`
+	GuestUsername      string `json:"guest_username"`
+	GuestPassword      string `json:"guest_password"`
+
+	AddressFamily  string   `json:"address_family"`
+	AddressCIDRs   []string `json:"address_cidrs"`
+	AddressNetwork string   `json:"address_network"`
+	AddressExclude []string `json:"address_exclude"`
+
+	ConnectInfoTTL     string `json:"connect_info_ttl"`
+	CredentialLifetime string `json:"credential_lifetime"`
+
+	MaxSize             int  `json:"max_size"`
+	MaxSizeFromCapacity bool `json:"max_size_from_capacity"`
+
+	Datastores              []string `json:"datastores"`
+	DatastoreSelection      string   `json:"datastore_selection"`
+	DatastoreMinFreePercent float64  `json:"datastore_min_free_percent"`
+
+	HostPlacement string `json:"host_placement"`
+
+	DRSVMGroup       string `json:"drs_vm_group"`
+	DRSHostGroup     string `json:"drs_host_group"`
+	DRSRule          string `json:"drs_rule"`
+	DRSRuleMandatory bool   `json:"drs_rule_mandatory"`
+
+	ManageSnapshot bool `json:"manage_snapshot"`
+
+	ParentManagement string `json:"parent_management"`
+	ParentFreeze     bool   `json:"parent_freeze"`
+
+	InstantCloneNewMAC    bool              `json:"instant_clone_new_mac"`
+	InstantCloneGuestinfo map[string]string `json:"instant_clone_guestinfo"`
+	InstantCloneWaitIP    bool              `json:"instant_clone_wait_ip"`
+
+	WarmPoolSize           int    `json:"warm_pool_size"`
+	WarmPoolRefillInterval string `json:"warm_pool_refill_interval"`
+	WarmPoolState          string `json:"warm_pool_state"`
+
+	Recycle        bool `json:"recycle"`
+	RecycleMaxUses int  `json:"recycle_max_uses"`
+
+	DiskSizeGB int64        `json:"disk_size_gb"`
+	Disks      []diskConfig `json:"disks"`
+
+	CoresPerSocket      int    `json:"cores_per_socket"`
+	CPUHotAdd           bool   `json:"cpu_hot_add"`
+	MemoryHotAdd        bool   `json:"memory_hot_add"`
+	CPUReservationMHz   int64  `json:"cpu_reservation_mhz"`
+	CPULimitMHz         int64  `json:"cpu_limit_mhz"`
+	CPUShares           string `json:"cpu_shares"`
+	MemoryReservationMB int64  `json:"memory_reservation_mb"`
+	MemoryLimitMB       int64  `json:"memory_limit_mb"`
+	MemoryShares        string `json:"memory_shares"`
+	LatencySensitivity  string `json:"latency_sensitivity"`
+	NestedHV            bool   `json:"nested_hv"`
+
+	Profiles map[string]instanceProfile `json:"profiles"`
+
+	ExtraConfig map[string]string `json:"extra_config"`
+
+	SecureBoot        bool   `json:"secure_boot"`
+	VTPM              bool   `json:"vtpm"`
+	StoragePolicy     string `json:"storage_policy"`
+	RequireEncryption bool   `json:"require_encryption"`
 }
 
 func (k *vSphereDeployment) Init(ctx context.Context, logger hclog.Logger, settings provider.Settings) (provider.ProviderInfo, error) {
@@ -73,8 +202,38 @@ func (k *vSphereDeployment) Init(ctx context.Context, logger hclog.Logger, setti
 	if k.Resourcepool == "" {
 		return provider.ProviderInfo{}, fmt.Errorf("please provide resourcepool in plug_config")
 	}
-	if k.Datastore == "" {
-		return provider.ProviderInfo{}, fmt.Errorf("please provide datastore in plug_config")
+	if k.Datastore == "" && len(k.Datastores) == 0 {
+		return provider.ProviderInfo{}, fmt.Errorf("please provide datastore or datastores in plug_config")
+	}
+	if k.DRSVMGroup != "" && k.DRSHostGroup == "" {
+		return provider.ProviderInfo{}, fmt.Errorf("please provide drs_host_group in plug_config when using drs_vm_group")
+	}
+	switch k.HostPlacement {
+	case "", hostPlacementHost, hostPlacementDRS, hostPlacementSpread:
+	default:
+		return provider.ProviderInfo{}, fmt.Errorf("unsupported host_placement in plug_config: %s", k.HostPlacement)
+	}
+	switch k.ParentManagement {
+	case "", parentManagementTemplate:
+	case parentManagementPerHost:
+		if k.HostPlacement == "" {
+			return provider.ProviderInfo{}, fmt.Errorf("please provide host_placement in plug_config when using parent_management %s", parentManagementPerHost)
+		}
+	default:
+		return provider.ProviderInfo{}, fmt.Errorf("unsupported parent_management in plug_config: %s", k.ParentManagement)
+	}
+	for key := range k.InstantCloneGuestinfo {
+		if !strings.HasPrefix(key, "guestinfo.") {
+			return provider.ProviderInfo{}, fmt.Errorf("invalid instant_clone_guestinfo key in plug_config: %s does not start with guestinfo.", key)
+		}
+	}
+	switch k.DatastoreSelection {
+	case "", datastoreSelectionFreeSpace, datastoreSelectionRoundRobin:
+	default:
+		return provider.ProviderInfo{}, fmt.Errorf("unsupported datastore_selection in plug_config: %s", k.DatastoreSelection)
+	}
+	if k.DatastoreMinFreePercent < 0 || k.DatastoreMinFreePercent > 100 {
+		return provider.ProviderInfo{}, fmt.Errorf("datastore_min_free_percent in plug_config must be between 0 and 100")
 	}
 	if k.Contentlibrary == "" {
 		return provider.ProviderInfo{}, fmt.Errorf("please provide contentlibrary in plug_config")
@@ -88,6 +247,113 @@ func (k *vSphereDeployment) Init(ctx context.Context, logger hclog.Logger, setti
 	if k.Memory == "" {
 		return provider.ProviderInfo{}, fmt.Errorf("please provide memory in plug_config")
 	}
+	if k.MaxSize < 0 {
+		return provider.ProviderInfo{}, fmt.Errorf("max_size in plug_config must not be negative")
+	}
+	if k.WarmPoolSize < 0 {
+		return provider.ProviderInfo{}, fmt.Errorf("warm_pool_size in plug_config must not be negative")
+	}
+	if k.WarmPoolSize > 0 && k.Deploytype == "instantclone" {
+		return provider.ProviderInfo{}, fmt.Errorf("warm_pool_size in plug_config is not supported with deploytype instantclone")
+	}
+	if k.Recycle && k.WarmPoolSize == 0 {
+		return provider.ProviderInfo{}, fmt.Errorf("please provide warm_pool_size in plug_config when using recycle")
+	}
+	if k.RecycleMaxUses < 0 {
+		return provider.ProviderInfo{}, fmt.Errorf("recycle_max_uses in plug_config must not be negative")
+	}
+	if k.DiskSizeGB < 0 {
+		return provider.ProviderInfo{}, fmt.Errorf("disk_size_gb in plug_config must not be negative")
+	}
+	for i, disk := range k.Disks {
+		if err := disk.validate(); err != nil {
+			return provider.ProviderInfo{}, fmt.Errorf("invalid disks[%d] in plug_config: %w", i, err)
+		}
+		// Recycling reverts to a snapshot, which independent persistent
+		// disks are not part of, so they would keep the previous job's data.
+		if k.Recycle && disk.Mode == "independent_persistent" {
+			return provider.ProviderInfo{}, fmt.Errorf("independent_persistent disks in plug_config are not supported with recycle")
+		}
+	}
+	if (k.DiskSizeGB > 0 || len(k.Disks) > 0) && k.Deploytype == "instantclone" {
+		return provider.ProviderInfo{}, fmt.Errorf("disk_size_gb and disks in plug_config are not supported with deploytype instantclone")
+	}
+	if k.DiskSizeGB > 0 && k.Deploytype == "linkedclone" {
+		return provider.ProviderInfo{}, fmt.Errorf("disk_size_gb in plug_config is not supported with deploytype linkedclone")
+	}
+	if err := k.hardwareConfig(&types.VirtualMachineConfigSpec{}, k.Cpu); err != nil {
+		return provider.ProviderInfo{}, fmt.Errorf("invalid hardware profile in plug_config: %w", err)
+	}
+	if k.hasHardwareProfile() && k.Deploytype == "instantclone" {
+		return provider.ProviderInfo{}, fmt.Errorf("hardware profile in plug_config is not supported with deploytype instantclone")
+	}
+	if err := validateExtraConfig(k.ExtraConfig); err != nil {
+		return provider.ProviderInfo{}, fmt.Errorf("invalid extra_config in plug_config: %w", err)
+	}
+	if len(k.ExtraConfig) > 0 && k.Deploytype == "instantclone" {
+		return provider.ProviderInfo{}, fmt.Errorf("extra_config in plug_config is not supported with deploytype instantclone, use instant_clone_guestinfo")
+	}
+	if k.RequireEncryption && k.StoragePolicy == "" {
+		return provider.ProviderInfo{}, fmt.Errorf("please provide storage_policy in plug_config when using require_encryption")
+	}
+	if k.hasSecurityOptions() && k.Deploytype == "instantclone" {
+		return provider.ProviderInfo{}, fmt.Errorf("secure_boot, vtpm and storage_policy in plug_config are not supported with deploytype instantclone")
+	}
+	if k.StoragePolicy != "" && k.Deploytype == "linkedclone" {
+		return provider.ProviderInfo{}, fmt.Errorf("storage_policy in plug_config is not supported with deploytype linkedclone")
+	}
+	if err := k.validateProfiles(); err != nil {
+		return provider.ProviderInfo{}, fmt.Errorf("invalid profiles in plug_config: %w", err)
+	}
+	if len(k.Profiles) > 0 && k.WarmPoolSize > 0 {
+		return provider.ProviderInfo{}, fmt.Errorf("profiles in plug_config are not supported with warm_pool_size")
+	}
+	if len(k.Profiles) > 0 && k.Deploytype == "instantclone" {
+		return provider.ProviderInfo{}, fmt.Errorf("profiles in plug_config are not supported with deploytype instantclone")
+	}
+	switch k.WarmPoolState {
+	case "", poolStatePoweredOff, poolStateSuspended:
+	default:
+		return provider.ProviderInfo{}, fmt.Errorf("unsupported warm_pool_state in plug_config: %s", k.WarmPoolState)
+	}
+	creationTimeout, err := parseDuration(k.CreationTimeout, 20*time.Minute)
+	if err != nil {
+		return provider.ProviderInfo{}, fmt.Errorf("invalid creation_timeout in plug_config: %w", err)
+	}
+	unreachableTimeout, err := parseDuration(k.UnreachableTimeout, 10*time.Minute)
+	if err != nil {
+		return provider.ProviderInfo{}, fmt.Errorf("invalid unreachable_timeout in plug_config: %w", err)
+	}
+	reaperInterval, err := parseDuration(k.ReaperInterval, 0)
+	if err != nil {
+		return provider.ProviderInfo{}, fmt.Errorf("invalid reaper_interval in plug_config: %w", err)
+	}
+	reaperMaxAge, err := parseDuration(k.ReaperMaxAge, 0)
+	if err != nil {
+		return provider.ProviderInfo{}, fmt.Errorf("invalid reaper_max_age in plug_config: %w", err)
+	}
+	warmPoolRefillInterval, err := parseDuration(k.WarmPoolRefillInterval, time.Minute)
+	if err != nil {
+		return provider.ProviderInfo{}, fmt.Errorf("invalid warm_pool_refill_interval in plug_config: %w", err)
+	}
+	if warmPoolRefillInterval <= 0 {
+		return provider.ProviderInfo{}, fmt.Errorf("warm_pool_refill_interval in plug_config must be positive")
+	}
+	connectInfoTTL, err := parseDuration(k.ConnectInfoTTL, 5*time.Minute)
+	if err != nil {
+		return provider.ProviderInfo{}, fmt.Errorf("invalid connect_info_ttl in plug_config: %w", err)
+	}
+	credentialLifetime, err := parseDuration(k.CredentialLifetime, 0)
+	if err != nil {
+		return provider.ProviderInfo{}, fmt.Errorf("invalid credential_lifetime in plug_config: %w", err)
+	}
+	if credentialLifetime > 0 && credentialLifetime <= 2*credentialRefreshMargin {
+		return provider.ProviderInfo{}, fmt.Errorf("credential_lifetime in plug_config must be longer than %s", 2*credentialRefreshMargin)
+	}
+	addresses, err := newAddressPolicy(k.AddressFamily, k.AddressCIDRs, k.AddressNetwork, k.AddressExclude)
+	if err != nil {
+		return provider.ProviderInfo{}, fmt.Errorf("invalid address policy in plug_config: %w", err)
+	}
 	url, err := url.Parse(k.Vsphereurl)
 	if err != nil {
 		return provider.ProviderInfo{}, err
@@ -98,6 +364,39 @@ func (k *vSphereDeployment) Init(ctx context.Context, logger hclog.Logger, setti
 		return provider.ProviderInfo{}, err
 	}
 
+	if logger == nil {
+		logger = hclog.NewNullLogger()
+	}
+	k.log = logger
+
+	if k.DRSVMGroup != "" {
+		finder := find.NewFinder(k.client.Client, false)
+		dc, err := finder.Datacenter(ctx, k.Datacenter)
+		if err != nil {
+			return provider.ProviderInfo{}, fmt.Errorf("failed to find datacenter '%s': %w", k.Datacenter, err)
+		}
+		finder.SetDatacenter(dc)
+
+		if err := k.ensureDRSRule(ctx, finder); err != nil {
+			return provider.ProviderInfo{}, fmt.Errorf("failed to set up DRS rule: %w", err)
+		}
+	}
+
+	maxSize := k.MaxSize
+	if maxSize == 0 {
+		maxSize = 50
+	}
+	if k.MaxSizeFromCapacity {
+		capacity, err := k.capacity(ctx)
+		if err != nil {
+			return provider.ProviderInfo{}, fmt.Errorf("failed to determine capacity: %w", err)
+		}
+		if capacity >= 0 && capacity < maxSize {
+			logger.Warn("limiting max size to available capacity", "max_size", maxSize, "capacity", capacity)
+			maxSize = capacity
+		}
+	}
+
 	version := os.Getenv("VERSION")
 	if version == "" {
 		version = "0.1.0"
@@ -109,9 +408,36 @@ func (k *vSphereDeployment) Init(ctx context.Context, logger hclog.Logger, setti
 	}
 
 	k.settings = settings
+	k.addresses = addresses
+	k.connectInfoTTL = connectInfoTTL
+	k.credentialLifetime = credentialLifetime
+	k.creationTimeout = creationTimeout
+	k.unreachableTimeout = unreachableTimeout
+	k.reaperInterval = reaperInterval
+	k.reaperMaxAge = reaperMaxAge
+	k.warmPoolRefillInterval = warmPoolRefillInterval
+
+	if err := k.inferStarted(ctx, time.Now()); err != nil {
+		return provider.ProviderInfo{}, fmt.Errorf("failed to list instances: %w", err)
+	}
+
+	// Background work must outlive the Init request context, so it gets its
+	// own context which is cancelled by Shutdown.
+	bgCtx, cancel := context.WithCancel(context.Background())
+	k.cancel = cancel
+	if k.reaperInterval > 0 {
+		k.wg.Add(1)
+		go k.runReaper(bgCtx)
+	}
+	if k.WarmPoolSize > 0 {
+		k.poolRefill = make(chan struct{}, 1)
+		k.wg.Add(1)
+		go k.runPoolRefill(bgCtx)
+	}
+
 	return provider.ProviderInfo{
 		ID:        "vSphere",
-		MaxSize:   50,
+		MaxSize:   maxSize,
 		Version:   version,
 		BuildInfo: buildInfo,
 	}, nil
@@ -123,42 +449,156 @@ func (k *vSphereDeployment) Update(ctx context.Context, fn func(instance string,
 		return nil
 	}
 
+	vms, err := k.listVMs(ctx, []string{"name", "runtime", "guest", "guestHeartbeatStatus", "config.createDate", "config.extraConfig", "recentTask"})
+	if err != nil {
+		return err
+	}
+
+	busy, err := k.busyVMs(ctx, vms)
+	if err != nil {
+		return err
+	}
+
+	var instances []mo.VirtualMachine
+	for _, vmInfo := range vms {
+		if k.isInstance(vmInfo.Name) {
+			instances = append(instances, vmInfo)
+		}
+	}
+
+	now := time.Now()
+	isBusy := func(vm mo.VirtualMachine) bool {
+		return busy[vm.Self] || k.isInflight(vm.Name)
+	}
+	ready := k.probeReadiness(ctx, instances, func(vm mo.VirtualMachine) bool {
+		return k.determineState(vm, isBusy(vm), true, k.hasStarted(vm.Name), time.Time{}, now) == provider.StateRunning
+	})
+
+	for _, vmInfo := range instances {
+		if k.isDestroying(vmInfo.Name) {
+			fn(vmInfo.Name, provider.StateDeleting)
+			continue
+		}
+
+		since := k.unreachableSince(vmInfo.Name, unreachable(vmInfo), now)
+		state := k.determineState(vmInfo, isBusy(vmInfo), ready[vmInfo.Name], k.hasStarted(vmInfo.Name), since, now)
+		switch state {
+		case provider.StateRunning:
+			k.setStarted(vmInfo.Name, true)
+		case provider.StateTimeout:
+			// Fleeting forgets timed out instances without calling
+			// Decrease, so they are destroyed here.
+			k.destroyTimedOut(ctx, vmInfo.Name)
+		}
+		fn(vmInfo.Name, state)
+	}
+	return nil
+}
+
+// destroyTimedOut destroys the timed out instance name in the background.
+// Until it is gone, Update reports it as deleting.
+func (k *vSphereDeployment) destroyTimedOut(ctx context.Context, name string) {
+	k.mu.Lock()
+	if k.destroying == nil {
+		k.destroying = make(map[string]bool)
+	}
+	k.destroying[name] = true
+	k.mu.Unlock()
+
+	// The destroy outlives the Update call; Shutdown waits for it.
+	ctx = context.WithoutCancel(ctx)
+	k.tasks.Add(1)
+	go func() {
+		defer k.tasks.Done()
+		defer func() {
+			k.mu.Lock()
+			delete(k.destroying, name)
+			k.mu.Unlock()
+		}()
+
+		finder := find.NewFinder(k.client.Client, true)
+		dc, err := finder.Datacenter(ctx, k.Datacenter)
+		if err == nil {
+			finder.SetDatacenter(dc)
+			err = deleteVMs(ctx, k.client, finder, k.Folder, []string{name})
+		}
+		if err != nil {
+			k.logger().Error("failed to destroy timed out instance", "instance", name, "err", err)
+			return
+		}
+		k.logger().Info("destroyed timed out instance", "instance", name)
+		k.setStarted(name, false)
+		k.setReady(name, false)
+		k.unreachableSince(name, false, time.Time{})
+	}()
+}
+
+// busyVMs returns the VMs which have a queued or running vCenter task.
+func (k *vSphereDeployment) busyVMs(ctx context.Context, vms []mo.VirtualMachine) (map[types.ManagedObjectReference]bool, error) {
+	var refs []types.ManagedObjectReference
+	for _, vm := range vms {
+		refs = append(refs, vm.RecentTask...)
+	}
+	if len(refs) == 0 {
+		return nil, nil
+	}
+
+	var tasks []mo.Task
+	pc := property.DefaultCollector(k.client.Client)
+	if err := pc.Retrieve(ctx, refs, []string{"info.state", "info.entity"}, &tasks); err != nil {
+		return nil, err
+	}
+
+	busy := make(map[types.ManagedObjectReference]bool)
+	for _, task := range tasks {
+		if task.Info.Entity == nil {
+			continue
+		}
+		switch task.Info.State {
+		case types.TaskInfoStateQueued, types.TaskInfoStateRunning:
+			busy[*task.Info.Entity] = true
+		}
+	}
+	return busy, nil
+}
+
+// listVMs returns the requested properties of every VM in the configured folder.
+func (k *vSphereDeployment) listVMs(ctx context.Context, props []string) ([]mo.VirtualMachine, error) {
 	finder := find.NewFinder(k.client.Client, false)
 
 	dc, err := finder.Datacenter(ctx, k.Datacenter)
 	if err != nil {
-		return fmt.Errorf("failed to find datacenter '%s': %w", k.Datacenter, err)
+		return nil, fmt.Errorf("failed to find datacenter '%s': %w", k.Datacenter, err)
 	}
 	finder.SetDatacenter(dc)
 
 	folder, err := finder.Folder(ctx, k.Folder)
-
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	var folderRef mo.Folder
 	err = folder.Properties(ctx, folder.Reference(), []string{"childEntity"}, &folderRef)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
+	var refs []types.ManagedObjectReference
 	for _, ref := range folderRef.ChildEntity {
 		if ref.Type == "VirtualMachine" {
-			vm := object.NewVirtualMachine(k.client.Client, ref.Reference())
-			var vmInfo mo.VirtualMachine
-			err = vm.Properties(ctx, vm.Reference(), []string{"name", "runtime", "guest"}, &vmInfo)
-			if err != nil {
-				return err
-			}
-
-			if strings.HasPrefix(vmInfo.Name, k.Prefix) {
-				state := determineState(vmInfo)
-				fn(vmInfo.Name, state)
-			}
+			refs = append(refs, ref)
 		}
 	}
-	return nil
+	if len(refs) == 0 {
+		return nil, nil
+	}
+
+	var vms []mo.VirtualMachine
+	pc := property.DefaultCollector(k.client.Client)
+	if err := pc.Retrieve(ctx, refs, props, &vms); err != nil {
+		return nil, err
+	}
+	return vms, nil
 }
 
 func (k *vSphereDeployment) Increase(ctx context.Context, n int) (int, error) {
@@ -167,8 +607,8 @@ func (k *vSphereDeployment) Increase(ctx context.Context, n int) (int, error) {
 		return n, nil
 	}
 
-	deployType := k.Deploytype
-	srcPath := k.Template
+	k.tasks.Add(1)
+	defer k.tasks.Done()
 
 	finder := find.NewFinder(k.client.Client, false)
 
@@ -178,47 +618,148 @@ func (k *vSphereDeployment) Increase(ctx context.Context, n int) (int, error) {
 	}
 	finder.SetDatacenter(dc)
 
+	var created []string
+	if k.WarmPoolSize > 0 {
+		created = k.takeFromPool(ctx, finder, n)
+		k.refillPoolSoon()
+	}
+
+	deployed, err := k.provisionProfiles(ctx, finder, n-len(created))
+	created = append(created, deployed...)
+
+	if k.DRSVMGroup != "" && len(created) > 0 {
+		if err := k.updateDRSGroup(ctx, finder, created, nil); err != nil {
+			k.logger().Error("failed to add instances to DRS VM group", "vm_group", k.DRSVMGroup, "instances", created, "err", err)
+		}
+	}
+
+	return len(created), err
+}
+
+// instanceName returns a new name for an instance.
+func (k *vSphereDeployment) instanceName() string {
+	return fmt.Sprintf("%s-%s", k.Prefix, uuid.New())
+}
+
+// provision clones n VMs from the template of profile, named by name, and
+// returns the names of those that were created.
+func (k *vSphereDeployment) provision(ctx context.Context, finder *find.Finder, n int, profile instanceProfile, name func() string, powerOn bool) ([]string, error) {
+	if n <= 0 {
+		return nil, nil
+	}
+
+	deployType := k.Deploytype
+	srcPath := profile.Template
+
 	srcVM, err := finder.VirtualMachine(ctx, srcPath)
 	if err != nil {
-		return 0, fmt.Errorf("failed to find source template VM '%s': %w", srcPath, err)
+		return nil, fmt.Errorf("failed to find source template VM '%s': %w", srcPath, err)
 	}
 
 	destFolder, err := finder.Folder(ctx, k.Folder)
 	if err != nil {
-		return 0, fmt.Errorf("failed to find destination folder '%s': %w", k.Folder, err)
+		return nil, fmt.Errorf("failed to find destination folder '%s': %w", k.Folder, err)
 	}
 
 	destFolderRef := destFolder.Reference()
 
+	datastores, err := k.selectDatastores(ctx, finder, srcVM, n)
+	if err != nil {
+		return nil, err
+	}
+
+	hosts, err := k.selectHosts(ctx, finder, srcVM, profile, len(datastores))
+	if err != nil {
+		return nil, err
+	}
+
+	parents := make([]*object.VirtualMachine, len(hosts))
+	if deployType == "instantclone" {
+		parents, err = k.instantCloneParents(ctx, finder, srcVM, destFolderRef, hosts, datastores)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	config, err := k.cloneConfig(ctx, finder, srcVM, profile)
+	if err != nil {
+		return nil, err
+	}
+
+	var snapshot *types.ManagedObjectReference
+	if deployType == "linkedclone" {
+		snapshot, err = k.linkedCloneSnapshot(ctx, srcVM)
+		if err != nil {
+			return nil, fmt.Errorf("error creating linked clone: %w", err)
+		}
+	}
+
 	var wg sync.WaitGroup
 	var errs []error
+	var created []string
 	var mu sync.Mutex
 
-	for i := 0; i < n; i++ {
+	for i, datastore := range datastores {
+		vmName := name()
+		k.setInflight(vmName, true)
 		wg.Add(1)
+		host := hosts[i]
+		source := srcVM
+		if parents[i] != nil {
+			source = parents[i]
+		}
 		go func(cloneNumber int) {
 			defer wg.Done()
-			err := deployVM(ctx, k.client, deployType, srcVM, destFolderRef, k.Prefix, finder, cloneNumber, k.Datacenter, k.Host, k.Cluster, k.Resourcepool, k.Datastore, k.Contentlibrary, k.Network, k.Cpu, k.Memory)
+			defer k.releaseAddress(vmName)
+			defer k.setInflight(vmName, false)
+			var identity instantCloneIdentity
+			var err error
+			if deployType == "instantclone" {
+				identity, err = k.instantCloneIdentity(ctx, source, vmName)
+			}
+			if err == nil {
+				err = deployVM(ctx, k.client, deployType, source, destFolderRef, vmName, finder, cloneNumber, k.Datacenter, host, k.Cluster, k.Resourcepool, datastore, k.Contentlibrary, k.Network, profile.Cpu, profile.Memory, snapshot, identity, config, powerOn && !k.Recycle)
+			}
+			if err == nil && k.Recycle {
+				if err = k.prepareRecycle(ctx, finder, vmName, powerOn); err != nil {
+					if delErr := deleteVMs(ctx, k.client, finder, k.Folder, []string{vmName}); delErr != nil {
+						k.logger().Error("failed to delete VM that did not power on", "instance", vmName, "err", delErr)
+					}
+				}
+			}
+			if err == nil && deployType == "instantclone" && k.InstantCloneWaitIP {
+				if err = k.waitDistinctAddress(ctx, finder, source, vmName); err != nil {
+					if delErr := deleteVMs(ctx, k.client, finder, k.Folder, []string{vmName}); delErr != nil {
+						k.logger().Error("failed to delete instant clone without distinct address", "instance", vmName, "err", delErr)
+					}
+				}
+			}
+			mu.Lock()
 			if err != nil {
-				mu.Lock()
 				errs = append(errs, err)
-				mu.Unlock()
+			} else {
+				created = append(created, vmName)
 			}
+			mu.Unlock()
 		}(i)
 	}
 
 	wg.Wait()
 
+	if len(datastores) < n {
+		errs = append(errs, fmt.Errorf("insufficient datastore capacity for %d of %d instances", n-len(datastores), n))
+	}
+
 	if len(errs) > 0 {
 		// Combine errors into a single error
 		var errorMessages []string
 		for _, err := range errs {
 			errorMessages = append(errorMessages, err.Error())
 		}
-		return n - len(errs), fmt.Errorf("failed to deploy all VMs: %s", strings.Join(errorMessages, "; "))
+		return created, fmt.Errorf("failed to deploy all VMs: %s", strings.Join(errorMessages, "; "))
 	}
 
-	return n, nil
+	return created, nil
 }
 
 func (k *vSphereDeployment) Decrease(ctx context.Context, instances []string) ([]string, error) {
@@ -227,6 +768,9 @@ func (k *vSphereDeployment) Decrease(ctx context.Context, instances []string) ([
 		return instances, nil
 	}
 
+	k.tasks.Add(1)
+	defer k.tasks.Done()
+
 	finder := find.NewFinder(k.client.Client, true)
 
 	dc, err := finder.Datacenter(ctx, k.Datacenter)
@@ -235,9 +779,26 @@ func (k *vSphereDeployment) Decrease(ctx context.Context, instances []string) ([
 	}
 	finder.SetDatacenter(dc)
 
-	if err := deleteVMs(ctx, k.client, finder, k.Folder, instances); err != nil {
+	if k.DRSVMGroup != "" {
+		if err := k.updateDRSGroup(ctx, finder, nil, instances); err != nil {
+			k.logger().Warn("failed to remove instances from DRS VM group", "vm_group", k.DRSVMGroup, "instances", instances, "err", err)
+		}
+	}
+
+	destroy := instances
+	if k.Recycle {
+		destroy = k.recycle(ctx, finder, instances)
+		k.refillPoolSoon()
+	}
+
+	if err := deleteVMs(ctx, k.client, finder, k.Folder, destroy); err != nil {
 		return nil, fmt.Errorf("error deleting VMs: %w", err)
 	}
+	for _, instance := range instances {
+		k.setReady(instance, false)
+		k.setStarted(instance, false)
+		k.unreachableSince(instance, false, time.Time{})
+	}
 	return instances, nil
 }
 
@@ -266,78 +827,277 @@ func (k *vSphereDeployment) ConnectInfo(ctx context.Context, instance string) (p
 	}
 
 	var vmInfo mo.VirtualMachine
-	err = vm.Properties(ctx, vm.Reference(), []string{"guest.net"}, &vmInfo)
+	err = vm.Properties(ctx, vm.Reference(), []string{"guest.net", "guest.ipAddress", "config.createDate"}, &vmInfo)
 	if err != nil {
 		return provider.ConnectInfo{}, err
 	}
 
-	var ip string
-	nics := vmInfo.Guest.Net
-	for _, nic := range nics {
-		if ip != "" {
-			break
-		}
+	addrs := k.addresses.addresses(vmInfo.Guest)
+	if len(addrs) == 0 {
+		return provider.ConnectInfo{}, fmt.Errorf("could not find an address matching the address policy for VM: %s", instance)
+	}
 
-		if mac := nic.MacAddress; mac == "" {
-			continue
+	// A second matching address, e.g. on another NIC, is offered as the
+	// external address.
+	var externalAddr string
+	if len(addrs) > 1 {
+		externalAddr = addrs[1]
+	}
+
+	var created *time.Time
+	if vmInfo.Config != nil {
+		created = vmInfo.Config.CreateDate
+	}
+
+	return provider.ConnectInfo{
+		ConnectorConfig: k.settings.ConnectorConfig,
+		ID:              instance,
+		InternalAddr:    addrs[0],
+		ExternalAddr:    externalAddr,
+		Expires:         connectInfoExpiry(time.Now(), created, k.connectInfoTTL, k.credentialLifetime),
+	}, nil
+}
+
+// credentialRefreshMargin is how long before rotating credentials expire that
+// the connection info is expired, so it is refreshed before keys rotate.
+const credentialRefreshMargin = 30 * time.Second
+
+// connectInfoExpiry returns when connection info handed out at now expires.
+// With a credential lifetime, credentials are assumed to rotate every lifetime
+// since the instance was created, and the info never outlives the current
+// credentials. A nil result means the info does not expire.
+func connectInfoExpiry(now time.Time, created *time.Time, ttl, lifetime time.Duration) *time.Time {
+	var expires time.Time
+	if ttl > 0 {
+		expires = now.Add(ttl)
+	}
+
+	if lifetime > 0 {
+		start := now
+		if created != nil && !created.After(now) {
+			start = *created
 		}
-		if nic.IpConfig == nil {
-			continue
+		next := start.Add((now.Sub(start)/lifetime + 1) * lifetime)
+		refresh := next.Add(-credentialRefreshMargin)
+		if !refresh.After(now) {
+			refresh = next
 		}
+		if expires.IsZero() || refresh.Before(expires) {
+			expires = refresh
+		}
+	}
 
-		for _, vmIP := range nic.IpAddress {
-			if net.ParseIP(vmIP).To4() == nil {
-				continue
-			}
+	if expires.IsZero() {
+		return nil
+	}
+	return &expires
+}
+
+// logger returns the plugin logger, which is only set once Init has run.
+func (k *vSphereDeployment) logger() hclog.Logger {
+	if k.log == nil {
+		return hclog.NewNullLogger()
+	}
+	return k.log
+}
+
+// setInflight marks or unmarks an instance as being deployed.
+func (k *vSphereDeployment) setInflight(name string, deploying bool) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if k.inflight == nil {
+		k.inflight = make(map[string]struct{})
+	}
+	if deploying {
+		k.inflight[name] = struct{}{}
+	} else {
+		delete(k.inflight, name)
+	}
+}
+
+func (k *vSphereDeployment) isInflight(name string) bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	_, ok := k.inflight[name]
+	return ok
+}
+
+// setStarted records or forgets that an instance was reported running.
+func (k *vSphereDeployment) setStarted(name string, started bool) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
 
-			ip = vmIP
-			break
+	if k.started == nil {
+		k.started = make(map[string]bool)
+	}
+	if started {
+		k.started[name] = true
+	} else {
+		delete(k.started, name)
+	}
+}
+
+func (k *vSphereDeployment) hasStarted(name string) bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	return k.started[name]
+}
+
+// inferStarted marks the instances older than creation_timeout as started.
+// started is only kept in memory, and such an instance survived its creation
+// deadline before the plugin was restarted, so it came up then.
+func (k *vSphereDeployment) inferStarted(ctx context.Context, now time.Time) error {
+	vms, err := k.listVMs(ctx, []string{"name", "config.createDate", "config.extraConfig"})
+	if err != nil {
+		return err
+	}
+	for _, vm := range vms {
+		if k.isInstance(vm.Name) && pastDeadline(vm, now, k.creationTimeout) {
+			k.setStarted(vm.Name, true)
 		}
 	}
+	return nil
+}
+
+// unreachableSince records whether the instance name is unreachable at now
+// and returns since when it has been, or the zero time if it is reachable.
+func (k *vSphereDeployment) unreachableSince(name string, unreachable bool, now time.Time) time.Time {
+	k.mu.Lock()
+	defer k.mu.Unlock()
 
-	if ip == "" {
-		return provider.ConnectInfo{}, fmt.Errorf("could not find an IPv4 address for VM: %s", instance)
+	if !unreachable {
+		delete(k.unreachable, name)
+		return time.Time{}
 	}
+	if k.unreachable == nil {
+		k.unreachable = make(map[string]time.Time)
+	}
+	since, ok := k.unreachable[name]
+	if !ok {
+		since = now
+		k.unreachable[name] = since
+	}
+	return since
+}
 
-	expires := time.Now().Add(5 * time.Minute)
+func (k *vSphereDeployment) isDestroying(name string) bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
 
-	return provider.ConnectInfo{
-		ConnectorConfig: k.settings.ConnectorConfig,
-		ID:              instance,
-		InternalAddr:    ip,
-		Expires:         &expires,
-	}, nil
+	return k.destroying[name]
 }
 
 func (k *vSphereDeployment) Shutdown(ctx context.Context) error {
-	return nil
+	if k.cancel != nil {
+		k.cancel()
+	}
+
+	// Return early if client is not initialized (for testing)
+	if k.client == nil {
+		return nil
+	}
+
+	var errs []error
+	if err := waitContext(ctx, &k.wg); err != nil {
+		errs = append(errs, fmt.Errorf("waiting for background tasks: %w", err))
+	}
+	if err := waitContext(ctx, &k.tasks); err != nil {
+		errs = append(errs, fmt.Errorf("waiting for in-flight clone and destroy tasks: %w", err))
+	}
 
+	if k.DeleteOnShutdown {
+		if err := k.deleteAllInstances(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("deleting instances on shutdown: %w", err))
+		}
+	}
+
+	// The session must not leak even if ctx ran out while waiting above.
+	logoutCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), logoutTimeout)
+	defer cancel()
+	if err := k.client.Logout(logoutCtx); err != nil {
+		errs = append(errs, fmt.Errorf("logging out of vCenter: %w", err))
+	}
+
+	return errors.Join(errs...)
+}
+
+// logoutTimeout bounds logging out of vCenter on shutdown.
+const logoutTimeout = 10 * time.Second
+
+// deleteAllInstances destroys every VM in the folder that carries the prefix.
+func (k *vSphereDeployment) deleteAllInstances(ctx context.Context) error {
+	vms, err := k.listVMs(ctx, []string{"name"})
+	if err != nil {
+		return err
+	}
+
+	finder := find.NewFinder(k.client.Client, true)
+	dc, err := finder.Datacenter(ctx, k.Datacenter)
+	if err != nil {
+		return fmt.Errorf("failed to find datacenter '%s': %w", k.Datacenter, err)
+	}
+	finder.SetDatacenter(dc)
+
+	var errs []error
+	for _, vm := range vms {
+		if !k.isInstance(vm.Name) {
+			continue
+		}
+		if err := deleteVMs(ctx, k.client, finder, k.Folder, []string{vm.Name}); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
 }
+
+// waitContext waits for wg, giving up when ctx is done.
+func waitContext(ctx context.Context, wg *sync.WaitGroup) error {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 func deployVM(ctx context.Context, client *govmomi.Client, deployType string,
 	srcVM *object.VirtualMachine, destFolderRef types.ManagedObjectReference,
-	prefix string, finder *find.Finder, cloneNumber int,
+	vmName string, finder *find.Finder, cloneNumber int,
 	datacenter string, host string, cluster string, resourcePool string,
 	datastore string, contentLibrary string, network string,
-	cpu string, memory string) error {
-	uuid := uuid.New()
-	vmName := fmt.Sprintf("%s-%s", prefix, uuid)
-
+	cpu string, memory string, snapshot *types.ManagedObjectReference, identity instantCloneIdentity,
+	config types.VirtualMachineConfigSpec, powerOn bool) error {
 	switch deploytype := deployType; deploytype {
 	case "instantclone":
 		err := deployVMInstantClone(ctx, client, srcVM, vmName, destFolderRef, finder,
-			datacenter, host, cluster, resourcePool, datastore, network, cpu, memory)
+			datacenter, host, cluster, resourcePool, datastore, network, cpu, memory, identity)
 		if err != nil {
 			return fmt.Errorf("error creating instant clone: %w", err)
 		}
 	case "clone":
 		err := deployVMClone(ctx, client, srcVM, vmName, destFolderRef, finder,
-			datacenter, host, cluster, resourcePool, datastore, network, cpu, memory)
+			datacenter, host, cluster, resourcePool, datastore, network, cpu, memory, nil, config, powerOn)
 		if err != nil {
 			return fmt.Errorf("error creating clone: %w", err)
 		}
+	case "linkedclone":
+		err := deployVMClone(ctx, client, srcVM, vmName, destFolderRef, finder,
+			datacenter, host, cluster, resourcePool, datastore, network, cpu, memory, snapshot, config, powerOn)
+		if err != nil {
+			return fmt.Errorf("error creating linked clone: %w", err)
+		}
 	case "librarydeploy", "contentlibrary":
 		err := deployFromContentLibrary(ctx, client, vmName, contentLibrary, srcVM.Name(),
-			destFolderRef, finder, datacenter, host, cluster, resourcePool, datastore, network, cpu, memory)
+			destFolderRef, finder, datacenter, host, cluster, resourcePool, datastore, network, cpu, memory, config, powerOn)
 		if err != nil {
 			return fmt.Errorf("error deploying from content library: %w", err)
 		}
@@ -386,14 +1146,16 @@ func deleteVMs(ctx context.Context, client *govmomi.Client, finder *find.Finder,
 func deployVMInstantClone(ctx context.Context, client *govmomi.Client, srcVM *object.VirtualMachine,
 	vmName string, destFolderRef types.ManagedObjectReference, finder *find.Finder,
 	datacenter string, host string, cluster string, resourcePool string,
-	datastore string, network string, cpu string, memory string) error {
+	datastore string, network string, cpu string, memory string, identity instantCloneIdentity) error {
 
 	// Create instant clone specification
 	spec := types.VirtualMachineInstantCloneSpec{
 		Name: vmName,
 		Location: types.VirtualMachineRelocateSpec{
-			Folder: &destFolderRef,
+			Folder:       &destFolderRef,
+			DeviceChange: identity.deviceChange,
 		},
+		Config: identity.extraConfig,
 	}
 
 	// Execute the instant clone using govmomi methods
@@ -418,22 +1180,20 @@ func deployVMInstantClone(ctx context.Context, client *govmomi.Client, srcVM *ob
 	return nil
 }
 
+// deployVMClone creates a full clone of srcVM or, if snapshot is set, a linked
+// clone whose disks are children of the snapshot's disks.
 func deployVMClone(ctx context.Context, client *govmomi.Client, srcVM *object.VirtualMachine,
 	vmName string, destFolderRef types.ManagedObjectReference, finder *find.Finder,
 	datacenter string, host string, cluster string, resourcePool string,
-	datastore string, network string, cpu string, memory string) error {
+	datastore string, network string, cpu string, memory string,
+	snapshot *types.ManagedObjectReference, config types.VirtualMachineConfigSpec, powerOn bool) error {
 
-	// Get resource pool and datastore references
+	// Get resource pool reference
 	rpObj, err := finder.ResourcePool(ctx, resourcePool)
 	if err != nil {
 		return fmt.Errorf("failed to find resource pool: %v", err)
 	}
 
-	dsObj, err := finder.Datastore(ctx, datastore)
-	if err != nil {
-		return fmt.Errorf("failed to find datastore: %v", err)
-	}
-
 	// Parse CPU and memory values
 	cpuCount, err := strconv.ParseInt(cpu, 10, 32)
 	if err != nil {
@@ -447,22 +1207,41 @@ func deployVMClone(ctx context.Context, client *govmomi.Client, srcVM *object.Vi
 
 	// Get references for clone spec
 	rpRef := rpObj.Reference()
-	dsRef := dsObj.Reference()
 
 	// Create clone specification
 	cloneSpec := types.VirtualMachineCloneSpec{
 		Location: types.VirtualMachineRelocateSpec{
-			Folder:    &destFolderRef,
-			Pool:      &rpRef,
-			Datastore: &dsRef,
+			Folder: &destFolderRef,
+			Pool:   &rpRef,
 		},
-		PowerOn:  true,
+		PowerOn:  powerOn,
 		Template: false,
-		Config: &types.VirtualMachineConfigSpec{
-			Name:     vmName,
-			NumCPUs:  int32(cpuCount),
-			MemoryMB: memoryMB,
-		},
+		Config:   &config,
+	}
+	cloneSpec.Config.Name = vmName
+	cloneSpec.Config.NumCPUs = int32(cpuCount)
+	cloneSpec.Config.MemoryMB = memoryMB
+
+	if snapshot != nil {
+		cloneSpec.Snapshot = snapshot
+		cloneSpec.Location.DiskMoveType = string(types.VirtualMachineRelocateDiskMoveOptionsCreateNewChildDiskBacking)
+	}
+
+	// The datastore may be a datastore cluster, in which case Storage DRS
+	// picks the member datastore.
+	dsRef, err := placeDatastore(ctx, client, finder, datastore, srcVM, vmName, cloneSpec)
+	if err != nil {
+		return err
+	}
+	cloneSpec.Location.Datastore = &dsRef
+
+	if host != "" {
+		hostObj, err := finder.HostSystem(ctx, host)
+		if err != nil {
+			return fmt.Errorf("failed to find host: %v", err)
+		}
+		hostRef := hostObj.Reference()
+		cloneSpec.Location.Host = &hostRef
 	}
 
 	// Get the destination folder object
@@ -487,7 +1266,8 @@ func deployVMClone(ctx context.Context, client *govmomi.Client, srcVM *object.Vi
 func deployFromContentLibrary(ctx context.Context, client *govmomi.Client, vmName string,
 	contentLibraryName string, templateName string, destFolderRef types.ManagedObjectReference,
 	finder *find.Finder, datacenter string, host string, cluster string,
-	resourcePool string, datastore string, network string, cpu string, memory string) error {
+	resourcePool string, datastore string, network string, cpu string, memory string,
+	config types.VirtualMachineConfigSpec, powerOn bool) error {
 
 	// For content library deployment, we'll use the template VM approach
 	// Find the template VM in the content library (assuming it's already deployed as a template)
@@ -496,17 +1276,12 @@ func deployFromContentLibrary(ctx context.Context, client *govmomi.Client, vmNam
 		return fmt.Errorf("failed to find template VM '%s' in content library: %v", templateName, err)
 	}
 
-	// Get resource pool and datastore references
+	// Get resource pool reference
 	rpObj, err := finder.ResourcePool(ctx, resourcePool)
 	if err != nil {
 		return fmt.Errorf("failed to find resource pool: %v", err)
 	}
 
-	dsObj, err := finder.Datastore(ctx, datastore)
-	if err != nil {
-		return fmt.Errorf("failed to find datastore: %v", err)
-	}
-
 	// Parse CPU and memory values
 	cpuCount, err := strconv.ParseInt(cpu, 10, 32)
 	if err != nil {
@@ -520,22 +1295,36 @@ func deployFromContentLibrary(ctx context.Context, client *govmomi.Client, vmNam
 
 	// Get references for clone spec
 	rpRef := rpObj.Reference()
-	dsRef := dsObj.Reference()
 
 	// Create clone specification for content library deployment
 	cloneSpec := types.VirtualMachineCloneSpec{
 		Location: types.VirtualMachineRelocateSpec{
-			Folder:    &destFolderRef,
-			Pool:      &rpRef,
-			Datastore: &dsRef,
+			Folder: &destFolderRef,
+			Pool:   &rpRef,
 		},
-		PowerOn:  true,
+		PowerOn:  powerOn,
 		Template: false,
-		Config: &types.VirtualMachineConfigSpec{
-			Name:     vmName,
-			NumCPUs:  int32(cpuCount),
-			MemoryMB: memoryMB,
-		},
+		Config:   &config,
+	}
+	cloneSpec.Config.Name = vmName
+	cloneSpec.Config.NumCPUs = int32(cpuCount)
+	cloneSpec.Config.MemoryMB = memoryMB
+
+	// The datastore may be a datastore cluster, in which case Storage DRS
+	// picks the member datastore.
+	dsRef, err := placeDatastore(ctx, client, finder, datastore, templateVM, vmName, cloneSpec)
+	if err != nil {
+		return err
+	}
+	cloneSpec.Location.Datastore = &dsRef
+
+	if host != "" {
+		hostObj, err := finder.HostSystem(ctx, host)
+		if err != nil {
+			return fmt.Errorf("failed to find host: %v", err)
+		}
+		hostRef := hostObj.Reference()
+		cloneSpec.Location.Host = &hostRef
 	}
 
 	// Get the destination folder object
@@ -557,39 +1346,87 @@ func deployFromContentLibrary(ctx context.Context, client *govmomi.Client, vmNam
 	return nil
 }
 
-func determineState(vm mo.VirtualMachine) provider.State {
-	if vm.Runtime.PowerState != "poweredOn" {
-		return provider.StateDeleting
+// determineState maps a VM to a fleeting instance state. busy reports whether
+// a task is still running against the VM, ready whether it passed the
+// readiness probes, started whether it was reported running before, and
+// since when the VM has been unreachable, if it is. VMs that cannot recover,
+// or that never became usable within creation_timeout after they were
+// created, are reported as timed out so that the autoscaler replaces them. A
+// VM that was running once stays running through a brief VMware Tools or
+// network outage, and for up to unreachable_timeout while its host is
+// disconnected or it is suspended, so its job is not cut short.
+func (k *vSphereDeployment) determineState(vm mo.VirtualMachine, busy bool, ready bool, started bool, since time.Time, now time.Time) provider.State {
+	if unreachable(vm) {
+		if started && (since.IsZero() || now.Sub(since) < k.unreachableTimeout) {
+			return provider.StateRunning
+		}
+		return provider.StateTimeout
 	}
 
-	var ip string
-	for _, nic := range vm.Guest.Net {
-		if ip != "" {
-			break
+	switch vm.Runtime.PowerState {
+	case types.VirtualMachinePowerStatePoweredOn:
+	default:
+		if busy {
+			return provider.StateCreating
 		}
+		return provider.StateDeleting
+	}
 
-		if mac := nic.MacAddress; mac == "" {
-			continue
+	if k.addresses.primary(vm.Guest) == "" || !guestHealthy(vm) || !ready {
+		if started {
+			return provider.StateRunning
 		}
-		if nic.IpConfig == nil {
-			continue
+		if busy || !pastDeadline(vm, now, k.creationTimeout) {
+			return provider.StateCreating
 		}
+		return provider.StateTimeout
+	}
 
-		for _, vmIP := range nic.IpAddress {
-			if net.ParseIP(vmIP).To4() == nil {
-				continue
-			}
+	return provider.StateRunning
+}
 
-			ip = vmIP
-			break
-		}
+// unreachable reports whether vm cannot run its job: its host is
+// disconnected, its files are inaccessible, or it is suspended.
+func unreachable(vm mo.VirtualMachine) bool {
+	switch vm.Runtime.ConnectionState {
+	case types.VirtualMachineConnectionStateDisconnected,
+		types.VirtualMachineConnectionStateInaccessible,
+		types.VirtualMachineConnectionStateInvalid,
+		types.VirtualMachineConnectionStateOrphaned:
+		return true
+	}
+	return vm.Runtime.PowerState == types.VirtualMachinePowerStateSuspended
+}
+
+// guestHealthy reports whether VMware Tools is running and, when heartbeats
+// are available, the guest heartbeat is not red.
+func guestHealthy(vm mo.VirtualMachine) bool {
+	if vm.Guest == nil {
+		return false
 	}
+	status := vm.Guest.ToolsRunningStatus
+	if status != "" && status != string(types.VirtualMachineToolsRunningStatusGuestToolsRunning) {
+		return false
+	}
+	return vm.GuestHeartbeatStatus != types.ManagedEntityStatusRed
+}
 
-	if ip == "" {
-		return provider.StateCreating
+// pastDeadline reports whether vm became an instance more than timeout ago.
+// VMs with an unknown creation date, or when no timeout is set, never expire.
+func pastDeadline(vm mo.VirtualMachine, now time.Time, timeout time.Duration) bool {
+	since, ok := instanceSince(vm)
+	if timeout <= 0 || !ok {
+		return false
 	}
+	return now.Sub(since) > timeout
+}
 
-	return provider.StateRunning
+// parseDuration parses an optional duration option, returning def when unset.
+func parseDuration(value string, def time.Duration) (time.Duration, error) {
+	if value == "" {
+		return def, nil
+	}
+	return time.ParseDuration(value)
 }
 
 func main() {
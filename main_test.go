@@ -4,16 +4,28 @@ import (
 	"context"
 	"net/url"
 	"testing"
+	"time"
 
 	"github.com/vmware/govmomi"
 	"github.com/vmware/govmomi/find"
+	"github.com/vmware/govmomi/session"
 	"github.com/vmware/govmomi/simulator"
 	"github.com/vmware/govmomi/vim25"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
 	"gitlab.com/gitlab-org/fleeting/fleeting/provider"
 )
 
 // withTestVSphere sets up a simulator and runs the provided test function.
 func withTestVSphere(t *testing.T, testFunc func(context.Context, *vSphereDeployment)) {
+	withTestModel(t, func(ctx context.Context, deployment *vSphereDeployment, _ *simulator.Model) {
+		testFunc(ctx, deployment)
+	})
+}
+
+// withTestModel is like withTestVSphere, but also passes the simulator
+// model so that tests can extend the simulator.
+func withTestModel(t *testing.T, testFunc func(context.Context, *vSphereDeployment, *simulator.Model)) {
 	model := simulator.VPX()
 	defer model.Remove()
 
@@ -45,7 +57,7 @@ func withTestVSphere(t *testing.T, testFunc func(context.Context, *vSphereDeploy
 			Memory:         "1024",
 		}
 
-		testFunc(ctx, deployment)
+		testFunc(ctx, deployment, model)
 		return nil
 	})
 
@@ -171,3 +183,362 @@ func TestVSphereDeployment_Update(t *testing.T) {
 		}
 	})
 }
+
+func TestVSphereDeployment_UpdateDestroysTimedOut(t *testing.T) {
+	withTestVSphere(t, func(ctx context.Context, deployment *vSphereDeployment) {
+		if _, err := deployment.Increase(ctx, 1); err != nil {
+			t.Fatalf("Increase() failed: %v", err)
+		}
+
+		finder := find.NewFinder(deployment.client.Client, true)
+		dc, err := finder.Datacenter(ctx, "DC0")
+		if err != nil {
+			t.Fatalf("Could not find datacenter: %v", err)
+		}
+		finder.SetDatacenter(dc)
+		vms, err := finder.VirtualMachineList(ctx, "/DC0/vm/test-vm-*")
+		if err != nil || len(vms) != 1 {
+			t.Fatalf("Expected one instance, got %d: %v", len(vms), err)
+		}
+		if state, _ := vms[0].PowerState(ctx); state != types.VirtualMachinePowerStatePoweredOn {
+			task, err := vms[0].PowerOn(ctx)
+			if err == nil {
+				err = task.Wait(ctx)
+			}
+			if err != nil {
+				t.Fatalf("Could not power on instance: %v", err)
+			}
+		}
+		// The simulated guest never reports an address, so the instance
+		// times out as soon as the deadline passes.
+		deployment.creationTimeout = time.Nanosecond
+
+		states := make(map[string]provider.State)
+		fn := func(instance string, state provider.State) {
+			states[instance] = state
+		}
+		if err := deployment.Update(ctx, fn); err != nil {
+			t.Fatalf("Update() failed: %v", err)
+		}
+		if states[vms[0].Name()] != provider.StateTimeout {
+			t.Errorf("Expected the instance to time out, got %q", states[vms[0].Name()])
+		}
+
+		deployment.tasks.Wait()
+		if _, err := finder.VirtualMachineList(ctx, "/DC0/vm/test-vm-*"); err == nil {
+			t.Error("Expected the timed out instance to be destroyed")
+		}
+	})
+}
+
+func TestVSphereDeployment_Shutdown(t *testing.T) {
+	withTestVSphere(t, func(ctx context.Context, deployment *vSphereDeployment) {
+		if _, err := deployment.Increase(ctx, 1); err != nil {
+			t.Fatalf("Increase() failed, cannot proceed with Shutdown test: %v", err)
+		}
+
+		deployment.DeleteOnShutdown = true
+		if err := deployment.Shutdown(ctx); err != nil {
+			t.Fatalf("Shutdown() failed: %v", err)
+		}
+
+		// The deployment's session was logged out, so verify with a new client.
+		u, err := url.Parse(deployment.Vsphereurl)
+		if err != nil {
+			t.Fatalf("Could not parse vSphere URL: %v", err)
+		}
+		client, err := govmomi.NewClient(ctx, u, true)
+		if err != nil {
+			t.Fatalf("Could not create client: %v", err)
+		}
+
+		finder := find.NewFinder(client.Client, true)
+		dc, err := finder.Datacenter(ctx, "DC0")
+		if err != nil {
+			t.Fatalf("Could not find datacenter: %v", err)
+		}
+		finder.SetDatacenter(dc)
+
+		if _, err := finder.VirtualMachineList(ctx, "/DC0/vm/test-vm-*"); err == nil {
+			t.Fatal("Expected instances to be deleted on shutdown")
+		}
+	})
+}
+
+func TestVSphereDeployment_ShutdownExpiredContext(t *testing.T) {
+	withTestVSphere(t, func(ctx context.Context, deployment *vSphereDeployment) {
+		expired, cancel := context.WithCancel(ctx)
+		cancel()
+		_ = deployment.Shutdown(expired)
+
+		s, err := session.NewManager(deployment.client.Client).UserSession(ctx)
+		if err != nil {
+			t.Fatalf("UserSession() failed: %v", err)
+		}
+		if s != nil {
+			t.Error("Expected the session to be logged out although the context expired")
+		}
+	})
+}
+
+func TestVSphereDeployment_InferStarted(t *testing.T) {
+	withTestVSphere(t, func(ctx context.Context, deployment *vSphereDeployment) {
+		if _, err := deployment.Increase(ctx, 1); err != nil {
+			t.Fatalf("Increase() failed: %v", err)
+		}
+		vms, err := deployment.listVMs(ctx, []string{"name"})
+		if err != nil {
+			t.Fatalf("listVMs() failed: %v", err)
+		}
+		var instance string
+		for _, vm := range vms {
+			if deployment.isInstance(vm.Name) {
+				instance = vm.Name
+			}
+		}
+
+		// A restarted plugin does not know which instances ran before.
+		deployment.setStarted(instance, false)
+		if err := deployment.inferStarted(ctx, time.Now()); err != nil {
+			t.Fatalf("inferStarted() failed: %v", err)
+		}
+		if deployment.hasStarted(instance) {
+			t.Error("Expected an instance within its creation timeout not to be started")
+		}
+
+		deployment.creationTimeout = time.Nanosecond
+		if err := deployment.inferStarted(ctx, time.Now()); err != nil {
+			t.Fatalf("inferStarted() failed: %v", err)
+		}
+		if !deployment.hasStarted(instance) {
+			t.Error("Expected an instance past its creation timeout to be started")
+		}
+	})
+}
+
+func TestVSphereDeployment_UnreachableSince(t *testing.T) {
+	deployment := &vSphereDeployment{}
+	first := time.Now()
+
+	if since := deployment.unreachableSince("test-vm-1", true, first); !since.Equal(first) {
+		t.Errorf("Expected unreachable since %v, got %v", first, since)
+	}
+	if since := deployment.unreachableSince("test-vm-1", true, first.Add(time.Minute)); !since.Equal(first) {
+		t.Errorf("Expected the first time to be kept, got %v", since)
+	}
+	if since := deployment.unreachableSince("test-vm-1", false, first.Add(2*time.Minute)); !since.IsZero() {
+		t.Errorf("Expected a reachable instance, got %v", since)
+	}
+}
+
+func TestDetermineState(t *testing.T) {
+	now := time.Now()
+	old := now.Add(-time.Hour)
+	young := now.Add(-time.Minute)
+	guest := &types.GuestInfo{
+		ToolsRunningStatus: string(types.VirtualMachineToolsRunningStatusGuestToolsRunning),
+		Net: []types.GuestNicInfo{{
+			MacAddress: "00:50:56:00:00:01",
+			IpConfig:   &types.NetIpConfigInfo{},
+			IpAddress:  []string{"10.0.0.5"},
+		}},
+	}
+	runtime := func(power types.VirtualMachinePowerState, conn types.VirtualMachineConnectionState) types.VirtualMachineRuntimeInfo {
+		return types.VirtualMachineRuntimeInfo{PowerState: power, ConnectionState: conn}
+	}
+	on := types.VirtualMachinePowerStatePoweredOn
+	connected := types.VirtualMachineConnectionStateConnected
+
+	tests := []struct {
+		name     string
+		vm       mo.VirtualMachine
+		busy     bool
+		notReady bool
+		started  bool
+		since    time.Time
+		want     provider.State
+	}{
+		{
+			name: "running",
+			vm:   mo.VirtualMachine{Runtime: runtime(on, connected), Guest: guest},
+			want: provider.StateRunning,
+		},
+		{
+			name: "orphaned",
+			vm:   mo.VirtualMachine{Runtime: runtime(on, types.VirtualMachineConnectionStateOrphaned), Guest: guest},
+			want: provider.StateTimeout,
+		},
+		{
+			name: "suspended",
+			vm:   mo.VirtualMachine{Runtime: runtime(types.VirtualMachinePowerStateSuspended, connected)},
+			want: provider.StateTimeout,
+		},
+		{
+			name: "powered off",
+			vm:   mo.VirtualMachine{Runtime: runtime(types.VirtualMachinePowerStatePoweredOff, connected)},
+			want: provider.StateDeleting,
+		},
+		{
+			name: "powered off while cloning",
+			vm:   mo.VirtualMachine{Runtime: runtime(types.VirtualMachinePowerStatePoweredOff, connected)},
+			busy: true,
+			want: provider.StateCreating,
+		},
+		{
+			name: "no IP yet",
+			vm: mo.VirtualMachine{
+				Runtime: runtime(on, connected),
+				Config:  &types.VirtualMachineConfigInfo{CreateDate: &young},
+			},
+			want: provider.StateCreating,
+		},
+		{
+			name: "no IP past creation timeout",
+			vm: mo.VirtualMachine{
+				Runtime: runtime(on, connected),
+				Config:  &types.VirtualMachineConfigInfo{CreateDate: &old},
+			},
+			want: provider.StateTimeout,
+		},
+		{
+			name:     "readiness probe pending",
+			vm:       mo.VirtualMachine{Runtime: runtime(on, connected), Guest: guest},
+			notReady: true,
+			want:     provider.StateCreating,
+		},
+		{
+			name: "red heartbeat past creation timeout",
+			vm: mo.VirtualMachine{
+				Runtime:              runtime(on, connected),
+				Guest:                guest,
+				GuestHeartbeatStatus: types.ManagedEntityStatusRed,
+				Config:               &types.VirtualMachineConfigInfo{CreateDate: &old},
+			},
+			want: provider.StateTimeout,
+		},
+		{
+			name: "tools restart on a long-lived instance",
+			vm: mo.VirtualMachine{
+				Runtime: runtime(on, connected),
+				Guest: &types.GuestInfo{
+					ToolsRunningStatus: string(types.VirtualMachineToolsRunningStatusGuestToolsNotRunning),
+				},
+				Config: &types.VirtualMachineConfigInfo{CreateDate: &old},
+			},
+			started: true,
+			want:    provider.StateRunning,
+		},
+		{
+			name: "red heartbeat on a long-lived instance",
+			vm: mo.VirtualMachine{
+				Runtime:              runtime(on, connected),
+				Guest:                guest,
+				GuestHeartbeatStatus: types.ManagedEntityStatusRed,
+				Config:               &types.VirtualMachineConfigInfo{CreateDate: &old},
+			},
+			started: true,
+			want:    provider.StateRunning,
+		},
+		{
+			name:    "host disconnect on a long-lived instance",
+			vm:      mo.VirtualMachine{Runtime: runtime(on, types.VirtualMachineConnectionStateDisconnected)},
+			started: true,
+			since:   young,
+			want:    provider.StateRunning,
+		},
+		{
+			name:    "suspended long-lived instance",
+			vm:      mo.VirtualMachine{Runtime: runtime(types.VirtualMachinePowerStateSuspended, connected)},
+			started: true,
+			since:   young,
+			want:    provider.StateRunning,
+		},
+		{
+			name:    "orphaned long-lived instance past unreachable timeout",
+			vm:      mo.VirtualMachine{Runtime: runtime(on, types.VirtualMachineConnectionStateOrphaned), Guest: guest},
+			started: true,
+			since:   old,
+			want:    provider.StateTimeout,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			deployment := &vSphereDeployment{creationTimeout: 20 * time.Minute, unreachableTimeout: 10 * time.Minute}
+			if got := deployment.determineState(tt.vm, tt.busy, !tt.notReady, tt.started, tt.since, now); got != tt.want {
+				t.Errorf("determineState() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConnectInfoExpiry(t *testing.T) {
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	created := now.Add(-50 * time.Minute)
+	at := func(d time.Duration) *time.Time {
+		t := now.Add(d)
+		return &t
+	}
+
+	tests := []struct {
+		name     string
+		created  *time.Time
+		ttl      time.Duration
+		lifetime time.Duration
+		want     *time.Time
+	}{
+		{name: "ttl only", ttl: 5 * time.Minute, want: at(5 * time.Minute)},
+		{name: "no expiry", want: nil},
+		{name: "ttl before rotation", created: &created, ttl: 5 * time.Minute, lifetime: time.Hour, want: at(5 * time.Minute)},
+		{name: "rotation before ttl", created: &created, ttl: time.Hour, lifetime: time.Hour, want: at(10*time.Minute - credentialRefreshMargin)},
+		{name: "rotation without ttl", created: &created, lifetime: 20 * time.Minute, want: at(10*time.Minute - credentialRefreshMargin)},
+		{name: "within refresh margin", created: &created, lifetime: 50*time.Minute + 10*time.Second, want: at(10 * time.Second)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := connectInfoExpiry(now, tt.created, tt.ttl, tt.lifetime)
+			if (got == nil) != (tt.want == nil) || got != nil && !got.Equal(*tt.want) {
+				t.Errorf("connectInfoExpiry() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVSphereDeployment_IncreaseLinkedClone(t *testing.T) {
+	withTestVSphere(t, func(ctx context.Context, deployment *vSphereDeployment) {
+		deployment.Deploytype = "linkedclone"
+
+		if _, err := deployment.Increase(ctx, 1); err == nil {
+			t.Fatal("Expected Increase() to fail for a template without snapshot")
+		}
+
+		finder := find.NewFinder(deployment.client.Client, true)
+		dc, err := finder.Datacenter(ctx, "DC0")
+		if err != nil {
+			t.Fatalf("Could not find datacenter: %v", err)
+		}
+		finder.SetDatacenter(dc)
+
+		template, err := finder.VirtualMachine(ctx, deployment.Template)
+		if err != nil {
+			t.Fatalf("Could not find template: %v", err)
+		}
+		task, err := template.CreateSnapshot(ctx, "base", "", false, false)
+		if err != nil {
+			t.Fatalf("CreateSnapshot() failed: %v", err)
+		}
+		if err := task.Wait(ctx); err != nil {
+			t.Fatalf("CreateSnapshot() task failed: %v", err)
+		}
+
+		deployment.Snapshot = "base"
+		n, err := deployment.Increase(ctx, 1)
+		if err != nil {
+			t.Fatalf("Increase() failed: %v", err)
+		}
+		if n != 1 {
+			t.Errorf("Expected to increase by 1, but got %d", n)
+		}
+	})
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/vmware/govmomi/find"
+	"github.com/vmware/govmomi/guest"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/property"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// Instant clone parent management modes accepted by the parent_management
+// option. Without one, the template must already be running.
+const (
+	// parentManagementTemplate powers on the template and uses it as the
+	// parent of all instant clones.
+	parentManagementTemplate = "template"
+	// parentManagementPerHost keeps a running parent, cloned from the
+	// template, on every host instances are placed on, so that children
+	// are created locally.
+	parentManagementPerHost = "per_host"
+)
+
+// Programs run in the guest to freeze an instant clone parent.
+const (
+	freezeProgramLinux   = "/usr/bin/vmware-rpctool"
+	freezeProgramWindows = `C:\Program Files\VMware\VMware Tools\rpctool.exe`
+)
+
+// instantCloneParents returns the parent VM for each of the instances placed
+// on hosts, preparing every parent for instant cloning first.
+func (k *vSphereDeployment) instantCloneParents(ctx context.Context, finder *find.Finder, srcVM *object.VirtualMachine,
+	destFolderRef types.ManagedObjectReference, hosts []string, datastores []string) ([]*object.VirtualMachine, error) {
+	k.parentMu.Lock()
+	defer k.parentMu.Unlock()
+
+	parents := make([]*object.VirtualMachine, len(hosts))
+	byHost := make(map[string]*object.VirtualMachine)
+	for i, host := range hosts {
+		if parent, ok := byHost[host]; ok {
+			parents[i] = parent
+			continue
+		}
+
+		parent := srcVM
+		if k.ParentManagement == parentManagementPerHost {
+			var err error
+			parent, err = k.hostParent(ctx, finder, srcVM, destFolderRef, host, datastores[i])
+			if err != nil {
+				return nil, err
+			}
+		}
+		if err := k.prepareParent(ctx, parent); err != nil {
+			return nil, fmt.Errorf("failed to prepare instant clone parent '%s': %w", parent.Name(), err)
+		}
+
+		byHost[host] = parent
+		parents[i] = parent
+	}
+	return parents, nil
+}
+
+// parentName returns the name of the instant clone parent kept on host.
+func parentName(template string, host string) string {
+	return fmt.Sprintf("%s-parent-%s", template, path.Base(host))
+}
+
+// hostParent returns the instant clone parent on host, cloning it from the
+// template if it does not exist yet.
+func (k *vSphereDeployment) hostParent(ctx context.Context, finder *find.Finder, srcVM *object.VirtualMachine,
+	destFolderRef types.ManagedObjectReference, host string, datastore string) (*object.VirtualMachine, error) {
+	name := parentName(srcVM.Name(), host)
+
+	parent, err := finder.VirtualMachine(ctx, k.Folder+name)
+	if err == nil {
+		return parent, nil
+	}
+	var notFound *find.NotFoundError
+	if !errors.As(err, &notFound) {
+		return nil, err
+	}
+
+	k.logger().Info("creating instant clone parent", "parent", name, "host", host)
+	err = deployVMClone(ctx, k.client, srcVM, name, destFolderRef, finder,
+		k.Datacenter, host, k.Cluster, k.Resourcepool, datastore, k.Network, k.Cpu, k.Memory, nil, types.VirtualMachineConfigSpec{}, true)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create instant clone parent '%s': %w", name, err)
+	}
+	return finder.VirtualMachine(ctx, k.Folder+name)
+}
+
+// prepareParent makes sure vm can be instant cloned: it must be frozen or
+// running with VMware Tools up. Unless parent management is enabled, a
+// parent that is not running is reported as an error rather than powered on.
+func (k *vSphereDeployment) prepareParent(ctx context.Context, vm *object.VirtualMachine) error {
+	var vmInfo mo.VirtualMachine
+	err := vm.Properties(ctx, vm.Reference(), []string{"runtime.powerState", "runtime.instantCloneFrozen"}, &vmInfo)
+	if err != nil {
+		return err
+	}
+	if frozen := vmInfo.Runtime.InstantCloneFrozen; frozen != nil && *frozen {
+		return nil
+	}
+
+	if vmInfo.Runtime.PowerState != types.VirtualMachinePowerStatePoweredOn {
+		if k.ParentManagement == "" {
+			return fmt.Errorf("parent is %s, instant clones require a running parent", vmInfo.Runtime.PowerState)
+		}
+		k.logger().Info("powering on instant clone parent", "parent", vm.Name())
+		task, err := vm.PowerOn(ctx)
+		if err != nil {
+			return err
+		}
+		if err := task.Wait(ctx); err != nil {
+			return err
+		}
+	}
+
+	if k.creationTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, k.creationTimeout)
+		defer cancel()
+	}
+
+	err = property.Wait(ctx, property.DefaultCollector(k.client.Client), vm.Reference(), []string{"guest.toolsRunningStatus"}, func(changes []types.PropertyChange) bool {
+		for _, change := range changes {
+			if change.Val == string(types.VirtualMachineToolsRunningStatusGuestToolsRunning) {
+				return true
+			}
+		}
+		return false
+	})
+	if err != nil {
+		return fmt.Errorf("waiting for VMware Tools: %w", err)
+	}
+
+	if !k.ParentFreeze {
+		return nil
+	}
+
+	// The guest family is only known once VMware Tools run, so it is read
+	// after waiting for them.
+	if err := vm.Properties(ctx, vm.Reference(), []string{"guest", "config.guestId"}, &vmInfo); err != nil {
+		return err
+	}
+	if err := k.recordParentAddresses(ctx, vm, vmInfo.Guest); err != nil {
+		return err
+	}
+	return k.freezeParent(ctx, vm, parentGuestFamily(vmInfo))
+}
+
+// recordParentAddresses records the addresses guest reports for vm in its
+// extraConfig, so instant clones can still be told apart from the parent
+// once it is frozen.
+func (k *vSphereDeployment) recordParentAddresses(ctx context.Context, vm *object.VirtualMachine, guest *types.GuestInfo) error {
+	addrs := k.addresses.addresses(guest)
+	if len(addrs) == 0 {
+		return nil
+	}
+
+	task, err := vm.Reconfigure(ctx, types.VirtualMachineConfigSpec{
+		ExtraConfig: []types.BaseOptionValue{&types.OptionValue{Key: parentAddressesKey, Value: strings.Join(addrs, ",")}},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to record parent addresses: %w", err)
+	}
+	if err := task.Wait(ctx); err != nil {
+		return fmt.Errorf("failed to record parent addresses: %w", err)
+	}
+	return nil
+}
+
+// parentGuestFamily returns the guest family reported by VMware Tools, or
+// the one implied by the configured guest OS if Tools report none.
+func parentGuestFamily(vm mo.VirtualMachine) string {
+	if vm.Guest != nil && vm.Guest.GuestFamily != "" {
+		return vm.Guest.GuestFamily
+	}
+	if vm.Config != nil && strings.HasPrefix(vm.Config.GuestId, "win") {
+		return string(types.VirtualMachineGuestOsFamilyWindowsGuest)
+	}
+	return ""
+}
+
+// freezeParent freezes vm, whose guest has the given family, through a guest
+// operation and waits until vCenter reports it frozen.
+func (k *vSphereDeployment) freezeParent(ctx context.Context, vm *object.VirtualMachine, family string) error {
+	pm, err := guest.NewOperationsManager(k.client.Client, vm.Reference()).ProcessManager(ctx)
+	if err != nil {
+		return err
+	}
+
+	k.logger().Info("freezing instant clone parent", "parent", vm.Name())
+	_, err = pm.StartProgram(ctx, k.guestAuth(), &types.GuestProgramSpec{
+		ProgramPath: freezeProgram(family),
+		Arguments:   "instantclone.freeze",
+	})
+	if err != nil {
+		return fmt.Errorf("failed to start freeze in guest: %w", err)
+	}
+
+	err = property.Wait(ctx, property.DefaultCollector(k.client.Client), vm.Reference(), []string{"runtime.instantCloneFrozen"}, func(changes []types.PropertyChange) bool {
+		for _, change := range changes {
+			if frozen, ok := change.Val.(bool); ok && frozen {
+				return true
+			}
+		}
+		return false
+	})
+	if err != nil {
+		return fmt.Errorf("waiting for parent to freeze: %w", err)
+	}
+	return nil
+}
+
+// freezeProgram returns the guest program that freezes a parent with the
+// given guest family.
+func freezeProgram(guestFamily string) string {
+	if guestFamily == string(types.VirtualMachineGuestOsFamilyWindowsGuest) {
+		return freezeProgramWindows
+	}
+	return freezeProgramLinux
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vmware/govmomi/find"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+func TestFreezeProgram(t *testing.T) {
+	if got := freezeProgram(string(types.VirtualMachineGuestOsFamilyWindowsGuest)); got != freezeProgramWindows {
+		t.Errorf("freezeProgram(windowsGuest) = %q, want %q", got, freezeProgramWindows)
+	}
+	if got := freezeProgram(string(types.VirtualMachineGuestOsFamilyLinuxGuest)); got != freezeProgramLinux {
+		t.Errorf("freezeProgram(linuxGuest) = %q, want %q", got, freezeProgramLinux)
+	}
+	if got := freezeProgram(""); got != freezeProgramLinux {
+		t.Errorf("freezeProgram(\"\") = %q, want %q", got, freezeProgramLinux)
+	}
+}
+
+func TestParentGuestFamily(t *testing.T) {
+	windows := string(types.VirtualMachineGuestOsFamilyWindowsGuest)
+	tests := []struct {
+		name string
+		vm   mo.VirtualMachine
+		want string
+	}{
+		{"reported by tools", mo.VirtualMachine{Guest: &types.GuestInfo{GuestFamily: windows}}, windows},
+		{"windows guest id", mo.VirtualMachine{Guest: &types.GuestInfo{}, Config: &types.VirtualMachineConfigInfo{GuestId: "windows2019srv_64Guest"}}, windows},
+		{"linux guest id", mo.VirtualMachine{Config: &types.VirtualMachineConfigInfo{GuestId: "ubuntu64Guest"}}, ""},
+		{"unknown", mo.VirtualMachine{}, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parentGuestFamily(tt.vm); got != tt.want {
+				t.Errorf("parentGuestFamily() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParentName(t *testing.T) {
+	if got := parentName("ubuntu", "/DC0/host/DC0_C0/DC0_C0_H1"); got != "ubuntu-parent-DC0_C0_H1" {
+		t.Errorf("parentName() = %q, want %q", got, "ubuntu-parent-DC0_C0_H1")
+	}
+}
+
+func TestVSphereDeployment_InstantCloneParents(t *testing.T) {
+	withTestVSphere(t, func(ctx context.Context, deployment *vSphereDeployment) {
+		// The simulator never reports VMware Tools running, so preparing a
+		// parent ends waiting for them.
+		deployment.creationTimeout = 100 * time.Millisecond
+
+		finder := find.NewFinder(deployment.client.Client, true)
+		dc, err := finder.Datacenter(ctx, "DC0")
+		if err != nil {
+			t.Fatalf("Could not find datacenter: %v", err)
+		}
+		finder.SetDatacenter(dc)
+
+		template, err := finder.VirtualMachine(ctx, deployment.Template)
+		if err != nil {
+			t.Fatalf("Could not find template: %v", err)
+		}
+		folder, err := finder.Folder(ctx, deployment.Folder)
+		if err != nil {
+			t.Fatalf("Could not find folder: %v", err)
+		}
+
+		task, err := template.PowerOff(ctx)
+		if err != nil {
+			t.Fatalf("PowerOff() failed: %v", err)
+		}
+		if err := task.Wait(ctx); err != nil {
+			t.Fatalf("PowerOff() task failed: %v", err)
+		}
+
+		hosts := []string{"", ""}
+		datastores := []string{"LocalDS_0", "LocalDS_0"}
+		_, err = deployment.instantCloneParents(ctx, finder, template, folder.Reference(), hosts, datastores)
+		if err == nil || !strings.Contains(err.Error(), "require a running parent") {
+			t.Errorf("Expected unmanaged parent that is powered off to fail, got %v", err)
+		}
+
+		deployment.ParentManagement = parentManagementTemplate
+		_, err = deployment.instantCloneParents(ctx, finder, template, folder.Reference(), hosts, datastores)
+		if err == nil || !strings.Contains(err.Error(), "VMware Tools") {
+			t.Errorf("Expected waiting for VMware Tools to time out, got %v", err)
+		}
+		state, err := template.PowerState(ctx)
+		if err != nil {
+			t.Fatalf("PowerState() failed: %v", err)
+		}
+		if state != types.VirtualMachinePowerStatePoweredOn {
+			t.Errorf("Expected managed parent to be powered on, got %s", state)
+		}
+
+		deployment.ParentManagement = parentManagementPerHost
+		deployment.HostPlacement = hostPlacementSpread
+		hosts = []string{"/DC0/host/DC0_C0/DC0_C0_H1"}
+		_, _ = deployment.instantCloneParents(ctx, finder, template, folder.Reference(), hosts, datastores)
+
+		parent, err := finder.VirtualMachine(ctx, deployment.Folder+parentName(template.Name(), hosts[0]))
+		if err != nil {
+			t.Fatalf("Expected parent to be created on host: %v", err)
+		}
+		host, err := parent.HostSystem(ctx)
+		if err != nil {
+			t.Fatalf("HostSystem() failed: %v", err)
+		}
+		if name, _ := host.ObjectName(ctx); name != "DC0_C0_H1" {
+			t.Errorf("Expected parent on DC0_C0_H1, got %s", name)
+		}
+	})
+}
+
+func TestVSphereDeployment_RecordParentAddresses(t *testing.T) {
+	withTestVSphere(t, func(ctx context.Context, deployment *vSphereDeployment) {
+		finder := find.NewFinder(deployment.client.Client, true)
+		dc, err := finder.Datacenter(ctx, "DC0")
+		if err != nil {
+			t.Fatalf("Could not find datacenter: %v", err)
+		}
+		finder.SetDatacenter(dc)
+
+		template, err := finder.VirtualMachine(ctx, deployment.Template)
+		if err != nil {
+			t.Fatalf("Could not find template: %v", err)
+		}
+
+		guest := &types.GuestInfo{IpAddress: "10.0.0.1", Net: []types.GuestNicInfo{{
+			MacAddress: "00:50:56:00:00:01",
+			IpAddress:  []string{"10.0.0.1"},
+			IpConfig:   &types.NetIpConfigInfo{},
+		}}}
+		if err := deployment.recordParentAddresses(ctx, template, guest); err != nil {
+			t.Fatalf("recordParentAddresses() failed: %v", err)
+		}
+
+		var vm mo.VirtualMachine
+		if err := template.Properties(ctx, template.Reference(), []string{"config.extraConfig"}, &vm); err != nil {
+			t.Fatalf("Properties() failed: %v", err)
+		}
+		if got := recordedParentAddresses(vm); len(got) != 1 || got[0] != "10.0.0.1" {
+			t.Errorf("Expected the parent address to be recorded, got %v", got)
+		}
+	})
+}
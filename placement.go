@@ -0,0 +1,442 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/find"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/property"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// placeDatastore returns the datastore to clone srcVM to. If datastore names a
+// datastore cluster (StoragePod) rather than a datastore, Storage DRS is asked
+// for a placement recommendation and the recommended datastore is used.
+func placeDatastore(ctx context.Context, client *govmomi.Client, finder *find.Finder,
+	datastore string, srcVM *object.VirtualMachine, vmName string,
+	cloneSpec types.VirtualMachineCloneSpec) (types.ManagedObjectReference, error) {
+
+	dsObj, err := finder.Datastore(ctx, datastore)
+	if err == nil {
+		return dsObj.Reference(), nil
+	}
+	var notFound *find.NotFoundError
+	if !errors.As(err, &notFound) {
+		return types.ManagedObjectReference{}, fmt.Errorf("failed to find datastore: %v", err)
+	}
+
+	pod, podErr := finder.DatastoreCluster(ctx, datastore)
+	if podErr != nil {
+		return types.ManagedObjectReference{}, fmt.Errorf("failed to find datastore or datastore cluster: %v", err)
+	}
+
+	podRef := pod.Reference()
+	srcRef := srcVM.Reference()
+	spec := types.StoragePlacementSpec{
+		Type:         string(types.StoragePlacementSpecPlacementTypeClone),
+		CloneName:    vmName,
+		CloneSpec:    &cloneSpec,
+		Vm:           &srcRef,
+		Folder:       cloneSpec.Location.Folder,
+		ResourcePool: cloneSpec.Location.Pool,
+		PodSelectionSpec: types.StorageDrsPodSelectionSpec{
+			StoragePod: &podRef,
+			InitialVmConfig: []types.VmPodConfigForPlacement{
+				{StoragePod: podRef},
+			},
+		},
+	}
+
+	result, err := object.NewStorageResourceManager(client.Client).RecommendDatastores(ctx, spec)
+	if err != nil {
+		return types.ManagedObjectReference{}, fmt.Errorf("failed to get Storage DRS recommendation for '%s': %v", datastore, err)
+	}
+
+	for _, rec := range result.Recommendations {
+		for _, action := range rec.Action {
+			if placement, ok := action.(*types.StoragePlacementAction); ok {
+				return placement.Destination, nil
+			}
+		}
+	}
+
+	return types.ManagedObjectReference{}, fmt.Errorf("storage DRS returned no placement recommendation for datastore cluster '%s'", datastore)
+}
+
+// datastoreFreeSpace returns the free space of the named datastore or, if it
+// names a datastore cluster, of all its member datastores.
+func datastoreFreeSpace(ctx context.Context, finder *find.Finder, datastore string) (int64, error) {
+	dsObj, err := finder.Datastore(ctx, datastore)
+	if err == nil {
+		var dsInfo mo.Datastore
+		if err := dsObj.Properties(ctx, dsObj.Reference(), []string{"summary.freeSpace"}, &dsInfo); err != nil {
+			return 0, err
+		}
+		return dsInfo.Summary.FreeSpace, nil
+	}
+
+	pod, podErr := finder.DatastoreCluster(ctx, datastore)
+	if podErr != nil {
+		return 0, fmt.Errorf("failed to find datastore: %v", err)
+	}
+	var podInfo mo.StoragePod
+	if err := pod.Properties(ctx, pod.Reference(), []string{"summary"}, &podInfo); err != nil {
+		return 0, err
+	}
+	if podInfo.Summary == nil {
+		return 0, nil
+	}
+	return podInfo.Summary.FreeSpace, nil
+}
+
+// Datastore selection strategies accepted by the datastore_selection option.
+const (
+	datastoreSelectionFreeSpace  = "freespace"
+	datastoreSelectionRoundRobin = "roundrobin"
+)
+
+// datastoreCandidate is a datastore from the datastores option that can
+// currently take new instances.
+type datastoreCandidate struct {
+	name     string
+	free     int64
+	capacity int64
+}
+
+// selectDatastores picks a datastore for each of n new instances. Without a
+// datastores list, every instance goes to the datastore option. Otherwise
+// datastores that are inaccessible, in maintenance mode, or would drop below
+// datastore_min_free_percent are skipped, and the rest are chosen by most
+// free space or round-robin. Fewer than n names are returned if the
+// datastores cannot hold all instances; an error if they cannot hold any.
+func (k *vSphereDeployment) selectDatastores(ctx context.Context, finder *find.Finder, srcVM *object.VirtualMachine, n int) ([]string, error) {
+	if len(k.Datastores) == 0 {
+		names := make([]string, n)
+		for i := range names {
+			names[i] = k.Datastore
+		}
+		return names, nil
+	}
+
+	var srcInfo mo.VirtualMachine
+	if err := srcVM.Properties(ctx, srcVM.Reference(), []string{"summary.storage"}, &srcInfo); err != nil {
+		return nil, err
+	}
+	var size int64
+	if storage := srcInfo.Summary.Storage; storage != nil && k.copiesDisks() {
+		size = storage.Committed + storage.Uncommitted
+	}
+	size += k.vmDatastoreDiskBytes()
+
+	var candidates []*datastoreCandidate
+	for _, name := range k.Datastores {
+		dsObj, err := finder.Datastore(ctx, name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find datastore: %v", err)
+		}
+		var dsInfo mo.Datastore
+		if err := dsObj.Properties(ctx, dsObj.Reference(), []string{"summary"}, &dsInfo); err != nil {
+			return nil, err
+		}
+
+		summary := dsInfo.Summary
+		if !summary.Accessible {
+			k.logger().Warn("skipping inaccessible datastore", "datastore", name)
+			continue
+		}
+		if summary.MaintenanceMode != "" && summary.MaintenanceMode != string(types.DatastoreSummaryMaintenanceModeStateNormal) {
+			k.logger().Warn("skipping datastore in maintenance mode", "datastore", name, "mode", summary.MaintenanceMode)
+			continue
+		}
+		candidates = append(candidates, &datastoreCandidate{name: name, free: summary.FreeSpace, capacity: summary.Capacity})
+	}
+
+	// fits reports whether another instance fits on ds without dropping
+	// below the minimum free percentage.
+	fits := func(ds *datastoreCandidate) bool {
+		free := ds.free - size
+		return free >= 0 && float64(free) >= float64(ds.capacity)*k.DatastoreMinFreePercent/100
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	var names []string
+	for len(names) < n {
+		var pick *datastoreCandidate
+		if k.DatastoreSelection == datastoreSelectionRoundRobin {
+			for i := range candidates {
+				ds := candidates[(k.nextDatastore+i)%len(candidates)]
+				if fits(ds) {
+					pick = ds
+					k.nextDatastore = (k.nextDatastore + i + 1) % len(candidates)
+					break
+				}
+			}
+		} else {
+			for _, ds := range candidates {
+				if fits(ds) && (pick == nil || ds.free > pick.free) {
+					pick = ds
+				}
+			}
+		}
+		if pick == nil {
+			break
+		}
+
+		pick.free -= size
+		names = append(names, pick.name)
+	}
+
+	if len(names) == 0 {
+		return nil, fmt.Errorf("insufficient datastore capacity: none of the datastores %v is accessible with %.0f%% free space left after a clone of %d bytes",
+			k.Datastores, k.DatastoreMinFreePercent, size)
+	}
+	return names, nil
+}
+
+// Host placement modes accepted by the host_placement option. Without a
+// mode, vCenter picks the host from the resource pool as before.
+const (
+	hostPlacementHost   = "host"
+	hostPlacementDRS    = "drs"
+	hostPlacementSpread = "spread"
+)
+
+// hostCandidate is a cluster host that can currently take new instances.
+type hostCandidate struct {
+	path      string
+	instances int
+	load      float64
+}
+
+// selectHosts picks the host for each of n new instances of profile
+// according to host_placement and returns their inventory paths. An empty
+// path leaves the choice to vCenter.
+func (k *vSphereDeployment) selectHosts(ctx context.Context, finder *find.Finder, srcVM *object.VirtualMachine, profile instanceProfile, n int) ([]string, error) {
+	paths := make([]string, n)
+
+	switch k.HostPlacement {
+	case "":
+		return paths, nil
+	case hostPlacementHost:
+		for i := range paths {
+			paths[i] = k.Host
+		}
+		return paths, nil
+	}
+
+	cluster, err := finder.ClusterComputeResource(ctx, k.Cluster)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find cluster: %v", err)
+	}
+
+	datastores, err := k.diskDatastores(ctx, finder)
+	if err != nil {
+		return nil, err
+	}
+
+	candidates, err := k.hostCandidates(ctx, cluster, datastores)
+	if err != nil {
+		return nil, err
+	}
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("no connected host outside maintenance mode with the disk datastores in cluster '%s'", k.Cluster)
+	}
+
+	if k.HostPlacement == hostPlacementDRS {
+		rpObj, err := finder.ResourcePool(ctx, k.Resourcepool)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find resource pool: %v", err)
+		}
+		// DRS does not see the clones of this batch, so each clone is
+		// placed among the hosts that received the fewest of them.
+		placed := make(map[types.ManagedObjectReference]int)
+		for i := range paths {
+			host, err := k.recommendHost(ctx, cluster, srcVM, profile, rpObj.Reference(), leastPlaced(candidates, placed))
+			if err != nil {
+				return nil, err
+			}
+			candidate, ok := candidates[host]
+			if !ok {
+				return nil, fmt.Errorf("DRS recommended host %s which is not usable", host.Value)
+			}
+			placed[host]++
+			paths[i] = candidate.path
+		}
+		return paths, nil
+	}
+
+	// Spread: prefer the host running the fewest of our instances, then the
+	// least loaded one.
+	for i := range paths {
+		var pick *hostCandidate
+		for _, candidate := range candidates {
+			if pick == nil ||
+				candidate.instances < pick.instances ||
+				candidate.instances == pick.instances && candidate.load < pick.load ||
+				candidate.instances == pick.instances && candidate.load == pick.load && candidate.path < pick.path {
+				pick = candidate
+			}
+		}
+		pick.instances++
+		paths[i] = pick.path
+	}
+	return paths, nil
+}
+
+// hostCandidates returns the connected hosts of cluster that are not in
+// maintenance mode and mount all of datastores, with their load and the
+// number of instances on them.
+func (k *vSphereDeployment) hostCandidates(ctx context.Context, cluster *object.ClusterComputeResource,
+	datastores []types.ManagedObjectReference) (map[types.ManagedObjectReference]*hostCandidate, error) {
+	hosts, err := cluster.Hosts(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(hosts) == 0 {
+		return nil, nil
+	}
+
+	var refs []types.ManagedObjectReference
+	paths := make(map[types.ManagedObjectReference]string)
+	for _, host := range hosts {
+		refs = append(refs, host.Reference())
+		paths[host.Reference()] = host.InventoryPath
+	}
+
+	var hostInfos []mo.HostSystem
+	pc := property.DefaultCollector(k.client.Client)
+	if err := pc.Retrieve(ctx, refs, []string{"name", "runtime", "summary.quickStats", "summary.hardware", "datastore"}, &hostInfos); err != nil {
+		return nil, err
+	}
+
+	candidates := make(map[types.ManagedObjectReference]*hostCandidate)
+	for _, host := range hostInfos {
+		if host.Runtime.ConnectionState != types.HostSystemConnectionStateConnected {
+			k.logger().Warn("skipping disconnected host", "host", host.Name, "state", host.Runtime.ConnectionState)
+			continue
+		}
+		if host.Runtime.InMaintenanceMode {
+			k.logger().Warn("skipping host in maintenance mode", "host", host.Name)
+			continue
+		}
+		if !mountsAll(host, datastores) {
+			k.logger().Debug("skipping host without the disk datastores", "host", host.Name)
+			continue
+		}
+
+		var load float64
+		if hw := host.Summary.Hardware; hw != nil {
+			stats := host.Summary.QuickStats
+			if cpu := int64(hw.CpuMhz) * int64(hw.NumCpuCores); cpu > 0 {
+				load = float64(stats.OverallCpuUsage) / float64(cpu)
+			}
+			if hw.MemorySize > 0 {
+				load = max(load, float64(stats.OverallMemoryUsage)*1024*1024/float64(hw.MemorySize))
+			}
+		}
+		candidates[host.Self] = &hostCandidate{path: paths[host.Self], load: load}
+	}
+
+	vms, err := k.listVMs(ctx, []string{"name", "runtime.host"})
+	if err != nil {
+		return nil, err
+	}
+	for _, vm := range vms {
+		if !k.isInstance(vm.Name) || vm.Runtime.Host == nil {
+			continue
+		}
+		if candidate, ok := candidates[*vm.Runtime.Host]; ok {
+			candidate.instances++
+		}
+	}
+
+	return candidates, nil
+}
+
+// mountsAll reports whether host mounts all of datastores.
+func mountsAll(host mo.HostSystem, datastores []types.ManagedObjectReference) bool {
+	for _, ds := range datastores {
+		if !slices.Contains(host.Datastore, ds) {
+			return false
+		}
+	}
+	return true
+}
+
+// leastPlaced returns the candidates that received the fewest clones so far
+// according to placed.
+func leastPlaced(candidates map[types.ManagedObjectReference]*hostCandidate,
+	placed map[types.ManagedObjectReference]int) map[types.ManagedObjectReference]*hostCandidate {
+	least := -1
+	for host := range candidates {
+		if least < 0 || placed[host] < least {
+			least = placed[host]
+		}
+	}
+
+	hosts := make(map[types.ManagedObjectReference]*hostCandidate)
+	for host, candidate := range candidates {
+		if placed[host] == least {
+			hosts[host] = candidate
+		}
+	}
+	return hosts
+}
+
+// recommendHost asks DRS which of the candidate hosts a clone of srcVM sized
+// by profile should run on.
+func (k *vSphereDeployment) recommendHost(ctx context.Context, cluster *object.ClusterComputeResource,
+	srcVM *object.VirtualMachine, profile instanceProfile, pool types.ManagedObjectReference,
+	candidates map[types.ManagedObjectReference]*hostCandidate) (types.ManagedObjectReference, error) {
+
+	cpuCount, err := strconv.ParseInt(profile.Cpu, 10, 32)
+	if err != nil {
+		return types.ManagedObjectReference{}, fmt.Errorf("invalid CPU count: %v", err)
+	}
+	memoryMB, err := strconv.ParseInt(profile.Memory, 10, 64)
+	if err != nil {
+		return types.ManagedObjectReference{}, fmt.Errorf("invalid memory size: %v", err)
+	}
+
+	var hosts []types.ManagedObjectReference
+	for host := range candidates {
+		hosts = append(hosts, host)
+	}
+
+	srcRef := srcVM.Reference()
+	config := &types.VirtualMachineConfigSpec{
+		NumCPUs:  int32(cpuCount),
+		MemoryMB: memoryMB,
+	}
+	result, err := cluster.PlaceVm(ctx, types.PlacementSpec{
+		PlacementType: string(types.PlacementSpecPlacementTypeClone),
+		Vm:            &srcRef,
+		CloneName:     k.Prefix,
+		ConfigSpec:    config,
+		Hosts:         hosts,
+		CloneSpec: &types.VirtualMachineCloneSpec{
+			Location: types.VirtualMachineRelocateSpec{Pool: &pool},
+			Config:   config,
+		},
+	})
+	if err != nil {
+		return types.ManagedObjectReference{}, fmt.Errorf("failed to get DRS placement recommendation: %v", err)
+	}
+
+	for _, rec := range result.Recommendations {
+		for _, action := range rec.Action {
+			if placement, ok := action.(*types.PlacementAction); ok && placement.TargetHost != nil {
+				return *placement.TargetHost, nil
+			}
+		}
+	}
+	return types.ManagedObjectReference{}, fmt.Errorf("DRS returned no placement recommendation for cluster '%s'", k.Cluster)
+}
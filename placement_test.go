@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/vmware/govmomi/find"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+	"gitlab.com/gitlab-org/fleeting/fleeting/provider"
+)
+
+func TestVSphereDeployment_IncreaseDatastoreCluster(t *testing.T) {
+	withTestVSphere(t, func(ctx context.Context, deployment *vSphereDeployment) {
+		finder := find.NewFinder(deployment.client.Client, true)
+		dc, err := finder.Datacenter(ctx, "DC0")
+		if err != nil {
+			t.Fatalf("Could not find datacenter: %v", err)
+		}
+		finder.SetDatacenter(dc)
+
+		folders, err := dc.Folders(ctx)
+		if err != nil {
+			t.Fatalf("Could not get datacenter folders: %v", err)
+		}
+		pod, err := folders.DatastoreFolder.CreateStoragePod(ctx, "DC0_POD0")
+		if err != nil {
+			t.Fatalf("Could not create datastore cluster: %v", err)
+		}
+		ds, err := finder.Datastore(ctx, "LocalDS_0")
+		if err != nil {
+			t.Fatalf("Could not find datastore: %v", err)
+		}
+		task, err := pod.MoveInto(ctx, []types.ManagedObjectReference{ds.Reference()})
+		if err != nil {
+			t.Fatalf("Could not move datastore into cluster: %v", err)
+		}
+		if err := task.Wait(ctx); err != nil {
+			t.Fatalf("Could not move datastore into cluster: %v", err)
+		}
+
+		deployment.Datastore = "DC0_POD0"
+		if _, err := deployment.Increase(ctx, 1); err != nil {
+			t.Fatalf("Increase() failed: %v", err)
+		}
+
+		vms, err := finder.VirtualMachineList(ctx, "/DC0/vm/test-vm-*")
+		if err != nil || len(vms) != 1 {
+			t.Fatalf("Expected 1 VM to be created: %v", err)
+		}
+		var vmInfo mo.VirtualMachine
+		if err := vms[0].Properties(ctx, vms[0].Reference(), []string{"datastore"}, &vmInfo); err != nil {
+			t.Fatalf("Could not get VM datastores: %v", err)
+		}
+		if len(vmInfo.Datastore) != 1 || vmInfo.Datastore[0] != ds.Reference() {
+			t.Errorf("Expected VM to be placed on %v, got %v", ds.Reference(), vmInfo.Datastore)
+		}
+	})
+}
+
+func TestVSphereDeployment_IncreaseDatastores(t *testing.T) {
+	withTestVSphere(t, func(ctx context.Context, deployment *vSphereDeployment) {
+		deployment.Datastore = ""
+		deployment.Datastores = []string{"LocalDS_0"}
+		deployment.DatastoreMinFreePercent = 100
+
+		n, err := deployment.Increase(ctx, 1)
+		if err == nil || !strings.Contains(err.Error(), "insufficient datastore capacity") {
+			t.Fatalf("Expected a capacity error, got: %v", err)
+		}
+		if n != 0 {
+			t.Errorf("Expected no instances to be created, got %d", n)
+		}
+
+		deployment.DatastoreMinFreePercent = 0
+		deployment.DatastoreSelection = datastoreSelectionRoundRobin
+		n, err = deployment.Increase(ctx, 2)
+		if err != nil {
+			t.Fatalf("Increase() failed: %v", err)
+		}
+		if n != 2 {
+			t.Errorf("Expected to increase by 2, but got %d", n)
+		}
+	})
+}
+
+func TestVSphereDeployment_InitDatastoreMinFreePercent(t *testing.T) {
+	withTestVSphere(t, func(ctx context.Context, deployment *vSphereDeployment) {
+		for _, percent := range []float64{-1, 101} {
+			deployment.DatastoreMinFreePercent = percent
+			if _, err := deployment.Init(ctx, nil, provider.Settings{}); err == nil {
+				t.Errorf("Expected datastore_min_free_percent %v to be rejected", percent)
+			}
+		}
+	})
+}
+
+func TestVSphereDeployment_IncreaseHostPlacement(t *testing.T) {
+	withTestVSphere(t, func(ctx context.Context, deployment *vSphereDeployment) {
+		deployment.HostPlacement = hostPlacementSpread
+		if _, err := deployment.Increase(ctx, 3); err != nil {
+			t.Fatalf("Increase() failed: %v", err)
+		}
+
+		vms, err := deployment.listVMs(ctx, []string{"name", "runtime.host"})
+		if err != nil {
+			t.Fatalf("Could not list VMs: %v", err)
+		}
+		hosts := make(map[types.ManagedObjectReference]int)
+		for _, vm := range vms {
+			if strings.HasPrefix(vm.Name, "test-vm") {
+				hosts[*vm.Runtime.Host]++
+			}
+		}
+		if len(hosts) != 3 {
+			t.Errorf("Expected instances to be spread over 3 hosts, got %v", hosts)
+		}
+
+		deployment.HostPlacement = hostPlacementDRS
+		if _, err := deployment.Increase(ctx, 1); err != nil {
+			t.Fatalf("Increase() with DRS placement failed: %v", err)
+		}
+	})
+}
+
+func TestLeastPlaced(t *testing.T) {
+	a := types.ManagedObjectReference{Type: "HostSystem", Value: "host-1"}
+	b := types.ManagedObjectReference{Type: "HostSystem", Value: "host-2"}
+	candidates := map[types.ManagedObjectReference]*hostCandidate{a: {path: "a"}, b: {path: "b"}}
+
+	if got := leastPlaced(candidates, nil); len(got) != 2 {
+		t.Errorf("Expected both hosts before any placement, got %d", len(got))
+	}
+	got := leastPlaced(candidates, map[types.ManagedObjectReference]int{a: 1})
+	if _, ok := got[b]; !ok || len(got) != 1 {
+		t.Errorf("Expected only the host without placements, got %v", got)
+	}
+}
+
+func TestMountsAll(t *testing.T) {
+	shared := types.ManagedObjectReference{Type: "Datastore", Value: "datastore-1"}
+	local := types.ManagedObjectReference{Type: "Datastore", Value: "datastore-2"}
+	host := mo.HostSystem{Datastore: []types.ManagedObjectReference{shared}}
+
+	if !mountsAll(host, nil) {
+		t.Error("Expected host to qualify without disk datastores")
+	}
+	if !mountsAll(host, []types.ManagedObjectReference{shared}) {
+		t.Error("Expected host mounting the datastore to qualify")
+	}
+	if mountsAll(host, []types.ManagedObjectReference{shared, local}) {
+		t.Error("Expected host without the local datastore not to qualify")
+	}
+}
@@ -0,0 +1,428 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/vmware/govmomi/find"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/property"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// The warm pool holds powered-off or suspended clones named
+// <prefix>-pool-<uuid>. They are not instances: Update, the reaper and
+// delete_on_shutdown leave them alone. Increase turns pool VMs into instances
+// by renaming and powering them on or resuming them, and the pool is
+// refilled in the background.
+
+// States warm pool VMs are kept in, accepted by the warm_pool_state option.
+const (
+	poolStatePoweredOff = "powered_off"
+	poolStateSuspended  = "suspended"
+)
+
+// claimedKey is the extraConfig key recording when a warm pool VM was taken
+// as an instance. Deadlines of such instances start then rather than when
+// the VM was cloned into the pool.
+const claimedKey = "fleeting.claimed"
+
+// poolName returns a new name for a warm pool VM.
+func (k *vSphereDeployment) poolName() string {
+	return fmt.Sprintf("%s-pool-%s", k.Prefix, uuid.New())
+}
+
+// isPoolName reports whether name follows the naming used for warm pool VMs.
+func isPoolName(prefix, name string) bool {
+	id, ok := strings.CutPrefix(name, prefix+"-pool-")
+	if !ok {
+		return false
+	}
+	_, err := uuid.Parse(id)
+	return err == nil
+}
+
+// isInstance reports whether the VM named name is an instance of this
+// plugin, as opposed to a warm pool VM or an unrelated VM.
+func (k *vSphereDeployment) isInstance(name string) bool {
+	return strings.HasPrefix(name, k.Prefix) && !isPoolName(k.Prefix, name)
+}
+
+// takeFromPool turns up to n warm pool VMs into instances, oldest first, and
+// returns their new names.
+func (k *vSphereDeployment) takeFromPool(ctx context.Context, finder *find.Finder, n int) []string {
+	k.poolMu.Lock()
+	defer k.poolMu.Unlock()
+
+	vms, err := k.listVMs(ctx, []string{"name", "runtime.powerState", "config.createDate"})
+	if err != nil {
+		k.logger().Error("failed to list warm pool", "err", err)
+		return nil
+	}
+
+	var pool []mo.VirtualMachine
+	for _, vm := range vms {
+		if !isPoolName(k.Prefix, vm.Name) || k.isInflight(vm.Name) {
+			continue
+		}
+		switch vm.Runtime.PowerState {
+		case types.VirtualMachinePowerStatePoweredOff, types.VirtualMachinePowerStateSuspended:
+			pool = append(pool, vm)
+		}
+	}
+	slices.SortFunc(pool, func(a, b mo.VirtualMachine) int {
+		return createDate(a).Compare(createDate(b))
+	})
+	if len(pool) > n {
+		pool = pool[:n]
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var taken []string
+	for _, vm := range pool {
+		name := k.instanceName()
+		k.setInflight(name, true)
+		wg.Add(1)
+		go func(vm mo.VirtualMachine) {
+			defer wg.Done()
+			defer k.releaseAddress(name)
+			defer k.setInflight(name, false)
+
+			suspended := vm.Runtime.PowerState == types.VirtualMachinePowerStateSuspended
+			err := k.claimPoolVM(ctx, finder, object.NewVirtualMachine(k.client.Client, vm.Self), name, suspended)
+			if err != nil {
+				k.logger().Error("failed to take VM from warm pool", "vm", vm.Name, "err", err)
+				return
+			}
+
+			k.logger().Info("took VM from warm pool", "vm", vm.Name, "instance", name, "resumed", suspended)
+			mu.Lock()
+			taken = append(taken, name)
+			mu.Unlock()
+		}(vm)
+	}
+	wg.Wait()
+
+	return taken
+}
+
+// claimPoolVM renames the pool VM vm to name, records when it was claimed in
+// its claimedKey extraConfig key and powers it on. A suspended VM
+// is resumed and only returned once the guest reports a fresh address, so
+// that the address it had when it was suspended is never handed out. A VM
+// that was renamed but fails to come up is destroyed, as it is neither a
+// usable instance nor part of the pool any more.
+func (k *vSphereDeployment) claimPoolVM(ctx context.Context, finder *find.Finder, vm *object.VirtualMachine, name string, suspended bool) error {
+	// Renaming and recording the claim time in one reconfiguration gives
+	// the VM a fresh creation deadline as soon as it is an instance.
+	task, err := vm.Reconfigure(ctx, types.VirtualMachineConfigSpec{
+		Name: name,
+		ExtraConfig: []types.BaseOptionValue{
+			&types.OptionValue{Key: claimedKey, Value: time.Now().UTC().Format(time.RFC3339Nano)},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if err := task.Wait(ctx); err != nil {
+		return fmt.Errorf("rename failed: %w", err)
+	}
+
+	task, err = vm.PowerOn(ctx)
+	if err == nil {
+		err = task.Wait(ctx)
+	}
+	if err != nil {
+		err = fmt.Errorf("power on failed: %w", err)
+	} else if suspended {
+		err = k.waitResumedAddress(ctx, vm, name)
+	}
+	if err != nil {
+		if delErr := deleteVMs(ctx, k.client, finder, k.Folder, []string{name}); delErr != nil {
+			k.logger().Error("failed to delete VM taken from warm pool", "instance", name, "err", delErr)
+		}
+		return err
+	}
+	return nil
+}
+
+// waitResumedAddress waits until the pool VM vm, resumed as the instance
+// name, reports an address no other instance uses, and claims it for name.
+// A resumed guest may report the lease it had before it was suspended, which
+// can have expired and been handed to another VM in the meantime.
+func (k *vSphereDeployment) waitResumedAddress(ctx context.Context, vm *object.VirtualMachine, name string) error {
+	var vmInfo mo.VirtualMachine
+	if err := vm.Properties(ctx, vm.Reference(), []string{"config.extraConfig"}, &vmInfo); err != nil {
+		return err
+	}
+	suspended := suspendedAddress(vmInfo)
+
+	addr, err := k.waitGuestAddress(ctx, vm, func(addr string) (bool, error) {
+		claimed, err := k.claimAddress(ctx, name, addr)
+		if err == nil && !claimed {
+			k.logger().Warn("resumed VM reported an address already in use", "instance", name, "address", addr, "suspended_address", suspended)
+		}
+		return claimed, err
+	})
+	if err != nil {
+		return err
+	}
+	k.logger().Debug("resumed VM reported a free address", "instance", name, "address", addr, "renumbered", addr != suspended)
+	return nil
+}
+
+// waitGuestAddress waits, bounded by the creation timeout, until VMware Tools
+// run in vm and report a primary address matching the address policy that
+// accept accepts, and returns it. A nil accept accepts any address. vCenter
+// drops the guest's network information while tools are not running, as in
+// a suspended VM, so an address reported this way is current.
+func (k *vSphereDeployment) waitGuestAddress(ctx context.Context, vm *object.VirtualMachine, accept func(addr string) (bool, error)) (string, error) {
+	if k.creationTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, k.creationTimeout)
+		defer cancel()
+	}
+
+	var addr string
+	var acceptErr error
+	err := property.Wait(ctx, property.DefaultCollector(k.client.Client), vm.Reference(), []string{"guest"}, func(changes []types.PropertyChange) bool {
+		for _, change := range changes {
+			guest, ok := change.Val.(types.GuestInfo)
+			if !ok || !k.hasGuestAddress(guest) {
+				continue
+			}
+			addr = k.addresses.primary(&guest)
+			if accept == nil {
+				return true
+			}
+			accepted, err := accept(addr)
+			if err != nil {
+				acceptErr = err
+				return true
+			}
+			if accepted {
+				return true
+			}
+		}
+		return false
+	})
+	if err == nil {
+		err = acceptErr
+	}
+	if err != nil {
+		return "", fmt.Errorf("waiting for guest address: %w", err)
+	}
+	return addr, nil
+}
+
+// hasGuestAddress reports whether VMware Tools run in the guest and report
+// an address matching the address policy.
+func (k *vSphereDeployment) hasGuestAddress(guest types.GuestInfo) bool {
+	return guest.ToolsRunningStatus == string(types.VirtualMachineToolsRunningStatusGuestToolsRunning) &&
+		k.addresses.primary(&guest) != ""
+}
+
+// instanceSince returns when vm became an instance: when it was taken from
+// the warm pool, or else when it was created. It reports false if neither
+// is known.
+func instanceSince(vm mo.VirtualMachine) (time.Time, bool) {
+	if vm.Config == nil {
+		return time.Time{}, false
+	}
+	for _, opt := range vm.Config.ExtraConfig {
+		o := opt.GetOptionValue()
+		if o.Key != claimedKey {
+			continue
+		}
+		if claimed, err := time.Parse(time.RFC3339Nano, fmt.Sprint(o.Value)); err == nil {
+			return claimed, true
+		}
+	}
+	if vm.Config.CreateDate == nil {
+		return time.Time{}, false
+	}
+	return *vm.Config.CreateDate, true
+}
+
+// createDate returns the creation time of vm, or the zero time if unknown.
+func createDate(vm mo.VirtualMachine) time.Time {
+	if vm.Config == nil || vm.Config.CreateDate == nil {
+		return time.Time{}
+	}
+	return *vm.Config.CreateDate
+}
+
+// refillPoolSoon asks the background refill to run without waiting for the
+// next interval.
+func (k *vSphereDeployment) refillPoolSoon() {
+	select {
+	case k.poolRefill <- struct{}{}:
+	default:
+	}
+}
+
+// runPoolRefill keeps the warm pool filled until ctx is cancelled.
+func (k *vSphereDeployment) runPoolRefill(ctx context.Context) {
+	defer k.wg.Done()
+
+	ticker := time.NewTicker(k.warmPoolRefillInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := k.refillPool(ctx); err != nil {
+			k.logger().Error("warm pool refill failed", "err", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-k.poolRefill:
+		}
+	}
+}
+
+// refillPool clones powered-off VMs until the warm pool holds
+// warm_pool_size VMs that takeFromPool can claim, counting those that are
+// still being cloned. Pool VMs left powered on, for instance by a suspend
+// that failed or a restart during one, are never claimed and are destroyed
+// once they are older than the creation timeout.
+func (k *vSphereDeployment) refillPool(ctx context.Context) error {
+	vms, err := k.listVMs(ctx, []string{"name", "runtime.powerState", "config.createDate"})
+	if err != nil {
+		return err
+	}
+
+	finder := find.NewFinder(k.client.Client, false)
+	dc, err := finder.Datacenter(ctx, k.Datacenter)
+	if err != nil {
+		return fmt.Errorf("failed to find datacenter '%s': %w", k.Datacenter, err)
+	}
+	finder.SetDatacenter(dc)
+
+	now := time.Now()
+	pool := make(map[string]bool)
+	for _, vm := range vms {
+		if !isPoolName(k.Prefix, vm.Name) || k.isInflight(vm.Name) {
+			continue
+		}
+		switch vm.Runtime.PowerState {
+		case types.VirtualMachinePowerStatePoweredOff, types.VirtualMachinePowerStateSuspended:
+			pool[vm.Name] = true
+			continue
+		}
+		if k.stalePoolVM(vm, now) {
+			k.logger().Info("destroying stale warm pool VM", "vm", vm.Name, "state", vm.Runtime.PowerState)
+			if err := deleteVMs(ctx, k.client, finder, k.Folder, []string{vm.Name}); err != nil {
+				k.logger().Error("failed to delete stale warm pool VM", "vm", vm.Name, "err", err)
+			}
+		}
+	}
+	k.mu.Lock()
+	for name := range k.inflight {
+		if isPoolName(k.Prefix, name) {
+			pool[name] = true
+		}
+	}
+	k.mu.Unlock()
+
+	missing := k.WarmPoolSize - len(pool)
+	if missing <= 0 {
+		return nil
+	}
+
+	k.logger().Info("refilling warm pool", "size", len(pool), "missing", missing)
+	if k.WarmPoolState != poolStateSuspended {
+		_, err = k.provision(ctx, finder, missing, k.profile(""), k.poolName, false)
+		return err
+	}
+
+	// Suspended pool VMs are booted first, so that resuming them skips the
+	// guest's boot.
+	created, err := k.provision(ctx, finder, missing, k.profile(""), k.poolName, true)
+	var wg sync.WaitGroup
+	for _, name := range created {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := k.suspendPoolVM(ctx, finder, name); err != nil {
+				k.logger().Error("failed to suspend warm pool VM", "vm", name, "err", err)
+			}
+		}()
+	}
+	wg.Wait()
+	return err
+}
+
+// stalePoolVM reports whether the pool VM vm, which takeFromPool cannot
+// claim in its power state, is older than the creation timeout. VMs without
+// a creation date are kept.
+func (k *vSphereDeployment) stalePoolVM(vm mo.VirtualMachine, now time.Time) bool {
+	if vm.Config == nil || vm.Config.CreateDate == nil {
+		return false
+	}
+	return now.Sub(*vm.Config.CreateDate) >= k.creationTimeout
+}
+
+// suspendedAddressKey is the extraConfig key recording the address a warm
+// pool VM had when it was suspended.
+const suspendedAddressKey = "fleeting.suspendedAddress"
+
+// suspendedAddress returns the address recorded for vm when it was
+// suspended, or an empty string.
+func suspendedAddress(vm mo.VirtualMachine) string {
+	if vm.Config == nil {
+		return ""
+	}
+	for _, opt := range vm.Config.ExtraConfig {
+		if o := opt.GetOptionValue(); o.Key == suspendedAddressKey {
+			return fmt.Sprint(o.Value)
+		}
+	}
+	return ""
+}
+
+// suspendPoolVM waits for the freshly booted pool VM name to come up,
+// records its address and suspends it. A VM that does not come up is
+// destroyed.
+func (k *vSphereDeployment) suspendPoolVM(ctx context.Context, finder *find.Finder, name string) error {
+	k.setInflight(name, true)
+	defer k.setInflight(name, false)
+
+	vm, err := finder.VirtualMachine(ctx, k.Folder+name)
+	if err != nil {
+		return fmt.Errorf("error finding VM %s: %w", name, err)
+	}
+
+	addr, err := k.waitGuestAddress(ctx, vm, nil)
+	if err == nil {
+		var task *object.Task
+		task, err = vm.Reconfigure(ctx, types.VirtualMachineConfigSpec{
+			ExtraConfig: []types.BaseOptionValue{&types.OptionValue{Key: suspendedAddressKey, Value: addr}},
+		})
+		if err == nil {
+			err = task.Wait(ctx)
+		}
+	}
+	if err == nil {
+		var task *object.Task
+		task, err = vm.Suspend(ctx)
+		if err == nil {
+			err = task.Wait(ctx)
+		}
+	}
+	if err != nil {
+		if delErr := deleteVMs(ctx, k.client, finder, k.Folder, []string{name}); delErr != nil {
+			k.logger().Error("failed to delete warm pool VM", "vm", name, "err", delErr)
+		}
+		return err
+	}
+	return nil
+}
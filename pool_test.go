@@ -0,0 +1,368 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/vmware/govmomi/find"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/simulator"
+	"github.com/vmware/govmomi/vim25/types"
+	"gitlab.com/gitlab-org/fleeting/fleeting/provider"
+)
+
+func TestIsPoolName(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"runner-pool-0b8e4f2a-6a43-4a52-9a5c-2f3c4b5d6e7f", true},
+		{"runner-0b8e4f2a-6a43-4a52-9a5c-2f3c4b5d6e7f", false},
+		{"runner-pool-template", false},
+		{"other-pool-0b8e4f2a-6a43-4a52-9a5c-2f3c4b5d6e7f", false},
+	}
+
+	for _, tt := range tests {
+		if got := isPoolName("runner", tt.name); got != tt.want {
+			t.Errorf("isPoolName(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestVSphereDeployment_WarmPool(t *testing.T) {
+	withTestVSphere(t, func(ctx context.Context, deployment *vSphereDeployment) {
+		deployment.WarmPoolSize = 2
+
+		if err := deployment.refillPool(ctx); err != nil {
+			t.Fatalf("refillPool() failed: %v", err)
+		}
+
+		pool := func() []string {
+			vms, err := deployment.listVMs(ctx, []string{"name", "runtime.powerState"})
+			if err != nil {
+				t.Fatalf("listVMs() failed: %v", err)
+			}
+			var names []string
+			for _, vm := range vms {
+				if isPoolName(deployment.Prefix, vm.Name) {
+					if vm.Runtime.PowerState != types.VirtualMachinePowerStatePoweredOff {
+						t.Errorf("Expected pool VM %s to be powered off, got %s", vm.Name, vm.Runtime.PowerState)
+					}
+					names = append(names, vm.Name)
+				}
+			}
+			return names
+		}
+
+		if got := pool(); len(got) != 2 {
+			t.Fatalf("Expected 2 pool VMs, got %v", got)
+		}
+
+		err := deployment.Update(ctx, func(instance string, state provider.State) {
+			t.Errorf("Expected pool VMs to be hidden from Update, got %s", instance)
+		})
+		if err != nil {
+			t.Fatalf("Update() failed: %v", err)
+		}
+
+		n, err := deployment.Increase(ctx, 3)
+		if err != nil {
+			t.Fatalf("Increase() failed: %v", err)
+		}
+		if n != 3 {
+			t.Errorf("Expected to increase by 3, but got %d", n)
+		}
+		if got := pool(); len(got) != 0 {
+			t.Errorf("Expected pool to be used up, got %v", got)
+		}
+
+		states := make(map[string]provider.State)
+		err = deployment.Update(ctx, func(instance string, state provider.State) {
+			states[instance] = state
+		})
+		if err != nil {
+			t.Fatalf("Update() failed: %v", err)
+		}
+		if len(states) != 3 {
+			t.Errorf("Expected 3 instances, got %v", states)
+		}
+		for instance := range states {
+			if !isInstanceName(deployment.Prefix, instance) {
+				t.Errorf("Expected instance name, got %s", instance)
+			}
+		}
+
+		if err := deployment.refillPool(ctx); err != nil {
+			t.Fatalf("refillPool() failed: %v", err)
+		}
+		if got := pool(); len(got) != 2 {
+			t.Errorf("Expected pool to be refilled to 2 VMs, got %v", got)
+		}
+	})
+}
+
+func TestVSphereDeployment_RefillPoolStale(t *testing.T) {
+	withTestVSphere(t, func(ctx context.Context, deployment *vSphereDeployment) {
+		deployment.WarmPoolSize = 1
+		if err := deployment.refillPool(ctx); err != nil {
+			t.Fatalf("refillPool() failed: %v", err)
+		}
+
+		poolVMs := func() map[string]types.VirtualMachinePowerState {
+			vms, err := deployment.listVMs(ctx, []string{"name", "runtime.powerState"})
+			if err != nil {
+				t.Fatalf("listVMs() failed: %v", err)
+			}
+			states := make(map[string]types.VirtualMachinePowerState)
+			for _, vm := range vms {
+				if isPoolName(deployment.Prefix, vm.Name) {
+					states[vm.Name] = vm.Runtime.PowerState
+				}
+			}
+			return states
+		}
+
+		var stale string
+		for name := range poolVMs() {
+			stale = name
+		}
+		if stale == "" {
+			t.Fatal("Expected a pool VM")
+		}
+
+		// A pool VM left powered on, as after a failed suspend, cannot be
+		// taken and must not count towards the pool.
+		finder := find.NewFinder(deployment.client.Client, true)
+		dc, err := finder.Datacenter(ctx, "DC0")
+		if err != nil {
+			t.Fatalf("Failed to find datacenter: %v", err)
+		}
+		finder.SetDatacenter(dc)
+		vm, err := finder.VirtualMachine(ctx, deployment.Folder+stale)
+		if err != nil {
+			t.Fatalf("Failed to find pool VM: %v", err)
+		}
+		task, err := vm.PowerOn(ctx)
+		if err != nil {
+			t.Fatalf("PowerOn() failed: %v", err)
+		}
+		if err := task.Wait(ctx); err != nil {
+			t.Fatalf("PowerOn() task failed: %v", err)
+		}
+
+		deployment.creationTimeout = time.Nanosecond
+		if err := deployment.refillPool(ctx); err != nil {
+			t.Fatalf("refillPool() failed: %v", err)
+		}
+
+		states := poolVMs()
+		if _, ok := states[stale]; ok {
+			t.Errorf("Expected the stale pool VM %s to be destroyed", stale)
+		}
+		if len(states) != 1 {
+			t.Fatalf("Expected the pool to be refilled to 1 VM, got %v", states)
+		}
+		for name, state := range states {
+			if state != types.VirtualMachinePowerStatePoweredOff {
+				t.Errorf("Expected pool VM %s to be powered off, got %s", name, state)
+			}
+		}
+	})
+}
+
+func TestVSphereDeployment_ClaimOldPoolVM(t *testing.T) {
+	withTestModel(t, func(ctx context.Context, deployment *vSphereDeployment, model *simulator.Model) {
+		deployment.WarmPoolSize = 1
+		deployment.creationTimeout = 20 * time.Minute
+		if err := deployment.refillPool(ctx); err != nil {
+			t.Fatalf("refillPool() failed: %v", err)
+		}
+
+		// The pool VM was cloned long before it is needed.
+		vms, err := deployment.listVMs(ctx, []string{"name"})
+		if err != nil {
+			t.Fatalf("listVMs() failed: %v", err)
+		}
+		cloned := time.Now().Add(-time.Hour)
+		for _, vm := range vms {
+			if isPoolName(deployment.Prefix, vm.Name) {
+				model.Map().Get(vm.Self).(*simulator.VirtualMachine).Config.CreateDate = &cloned
+			}
+		}
+
+		if n, err := deployment.Increase(ctx, 1); err != nil || n != 1 {
+			t.Fatalf("Increase() = %d, %v", n, err)
+		}
+
+		var instances int
+		err = deployment.Update(ctx, func(instance string, state provider.State) {
+			instances++
+			if state != provider.StateCreating {
+				t.Errorf("Expected the instance taken from the pool to be creating, got %s", state)
+			}
+		})
+		if err != nil {
+			t.Fatalf("Update() failed: %v", err)
+		}
+		if instances != 1 {
+			t.Fatalf("Expected 1 instance, got %d", instances)
+		}
+
+		vms, err = deployment.listVMs(ctx, []string{"name", "runtime.powerState", "guest.net", "config.createDate", "config.extraConfig"})
+		if err != nil {
+			t.Fatalf("listVMs() failed: %v", err)
+		}
+		for _, vm := range vms {
+			if deployment.isInstance(vm.Name) {
+				if reason := deployment.reapReason(vm, time.Now()); reason != "" {
+					t.Errorf("Expected the instance taken from the pool not to be reaped, got %q", reason)
+				}
+			}
+		}
+	})
+}
+
+func TestVSphereDeployment_HasGuestAddress(t *testing.T) {
+	deployment := &vSphereDeployment{}
+	running := string(types.VirtualMachineToolsRunningStatusGuestToolsRunning)
+	nic := types.GuestNicInfo{
+		MacAddress: "00:50:56:00:00:01",
+		IpAddress:  []string{"192.168.1.10"},
+		IpConfig:   &types.NetIpConfigInfo{},
+	}
+
+	tests := []struct {
+		name  string
+		guest types.GuestInfo
+		want  bool
+	}{
+		{"tools not running", types.GuestInfo{ToolsRunningStatus: string(types.VirtualMachineToolsRunningStatusGuestToolsNotRunning), Net: []types.GuestNicInfo{nic}}, false},
+		{"no address", types.GuestInfo{ToolsRunningStatus: running}, false},
+		{"address", types.GuestInfo{ToolsRunningStatus: running, Net: []types.GuestNicInfo{nic}}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := deployment.hasGuestAddress(tt.guest); got != tt.want {
+				t.Errorf("hasGuestAddress() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVSphereDeployment_WaitResumedAddress(t *testing.T) {
+	withTestModel(t, func(ctx context.Context, deployment *vSphereDeployment, model *simulator.Model) {
+		deployment.creationTimeout = 500 * time.Millisecond
+		guest := func(addr string) *types.GuestInfo {
+			return &types.GuestInfo{
+				ToolsRunningStatus: string(types.VirtualMachineToolsRunningStatusGuestToolsRunning),
+				IpAddress:          addr,
+				Net: []types.GuestNicInfo{{
+					MacAddress: "00:50:56:00:00:01",
+					IpAddress:  []string{addr},
+					IpConfig:   &types.NetIpConfigInfo{},
+				}},
+			}
+		}
+
+		if n, err := deployment.Increase(ctx, 1); err != nil || n != 1 {
+			t.Fatalf("Increase() = %d, %v", n, err)
+		}
+		vms, err := deployment.listVMs(ctx, []string{"name"})
+		if err != nil {
+			t.Fatalf("listVMs() failed: %v", err)
+		}
+		for _, vm := range vms {
+			if deployment.isInstance(vm.Name) {
+				model.Map().Get(vm.Self).(*simulator.VirtualMachine).Guest = guest("10.0.0.1")
+			}
+		}
+
+		// The resumed VM reports the lease it had before it was suspended,
+		// which another instance got in the meantime.
+		finder := find.NewFinder(deployment.client.Client, true)
+		dc, err := finder.Datacenter(ctx, "DC0")
+		if err != nil {
+			t.Fatalf("Could not find datacenter: %v", err)
+		}
+		finder.SetDatacenter(dc)
+		resumed, err := finder.VirtualMachine(ctx, deployment.Template)
+		if err != nil {
+			t.Fatalf("Could not find template: %v", err)
+		}
+		model.Map().Get(resumed.Reference()).(*simulator.VirtualMachine).Guest = guest("10.0.0.1")
+
+		name := deployment.instanceName()
+		if err := deployment.waitResumedAddress(ctx, resumed, name); err == nil {
+			t.Error("Expected an address used by another instance to be rejected")
+		}
+
+		model.Map().Get(resumed.Reference()).(*simulator.VirtualMachine).Guest = guest("10.0.0.2")
+		if err := deployment.waitResumedAddress(ctx, resumed, name); err != nil {
+			t.Errorf("waitResumedAddress() failed: %v", err)
+		}
+		if addr := deployment.claimed[name]; addr != "10.0.0.2" {
+			t.Errorf("Expected the fresh address to be claimed, got %q", addr)
+		}
+	})
+}
+
+func TestVSphereDeployment_SuspendedPool(t *testing.T) {
+	withTestVSphere(t, func(ctx context.Context, deployment *vSphereDeployment) {
+		// The simulator never reports VMware Tools running, so suspended
+		// pool VMs never come up with a fresh address.
+		deployment.creationTimeout = 100 * time.Millisecond
+		deployment.WarmPoolSize = 1
+
+		if err := deployment.refillPool(ctx); err != nil {
+			t.Fatalf("refillPool() failed: %v", err)
+		}
+		vms, err := deployment.listVMs(ctx, []string{"name"})
+		if err != nil {
+			t.Fatalf("listVMs() failed: %v", err)
+		}
+		var poolVM types.ManagedObjectReference
+		for _, vm := range vms {
+			if isPoolName(deployment.Prefix, vm.Name) {
+				poolVM = vm.Self
+			}
+		}
+		if poolVM.Value == "" {
+			t.Fatal("Expected a pool VM")
+		}
+
+		vm := object.NewVirtualMachine(deployment.client.Client, poolVM)
+		for _, op := range []func(context.Context) (*object.Task, error){vm.PowerOn, vm.Suspend} {
+			task, err := op(ctx)
+			if err != nil {
+				t.Fatalf("Power operation failed: %v", err)
+			}
+			if err := task.Wait(ctx); err != nil {
+				t.Fatalf("Power operation task failed: %v", err)
+			}
+		}
+
+		finder := find.NewFinder(deployment.client.Client, true)
+		dc, err := finder.Datacenter(ctx, "DC0")
+		if err != nil {
+			t.Fatalf("Could not find datacenter: %v", err)
+		}
+		finder.SetDatacenter(dc)
+
+		taken := deployment.takeFromPool(ctx, finder, 1)
+		if len(taken) != 0 {
+			t.Errorf("Expected resumed VM without fresh address not to be taken, got %v", taken)
+		}
+
+		vms, err = deployment.listVMs(ctx, []string{"name"})
+		if err != nil {
+			t.Fatalf("listVMs() failed: %v", err)
+		}
+		for _, vm := range vms {
+			if vm.Self == poolVM {
+				t.Errorf("Expected VM %s to be destroyed", vm.Name)
+			}
+		}
+	})
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+
+	"github.com/vmware/govmomi/find"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// profileKey is the extraConfig key recording which profile an instance was
+// created from.
+const profileKey = "fleeting.profile"
+
+// instanceProfile is a named flavor of instance. Unset fields fall back to
+// the top-level template, cpu and memory.
+type instanceProfile struct {
+	Template string `json:"template"`
+	Cpu      string `json:"cpu"`
+	Memory   string `json:"memory"`
+	Weight   *int   `json:"weight"`
+
+	// name is the profile name, empty for the top-level configuration.
+	name string
+}
+
+// profile returns the named profile with unset fields filled in from the
+// top-level configuration. The empty name returns the top-level
+// configuration itself.
+func (k *vSphereDeployment) profile(name string) instanceProfile {
+	profile := k.Profiles[name]
+	profile.name = name
+	if profile.Template == "" {
+		profile.Template = k.Template
+	}
+	if profile.Cpu == "" {
+		profile.Cpu = k.Cpu
+	}
+	if profile.Memory == "" {
+		profile.Memory = k.Memory
+	}
+	return profile
+}
+
+// weight returns the share of instances created from the profile.
+func (p instanceProfile) weight() int {
+	if p.Weight == nil {
+		return 1
+	}
+	return *p.Weight
+}
+
+// profileNames returns the configured profile names in order.
+func (k *vSphereDeployment) profileNames() []string {
+	var names []string
+	for name := range k.Profiles {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// validateProfiles checks the profiles option.
+func (k *vSphereDeployment) validateProfiles() error {
+	total := 0
+	for _, name := range k.profileNames() {
+		if name == "" {
+			return fmt.Errorf("profile names must not be empty")
+		}
+		profile := k.profile(name)
+		if profile.weight() < 0 {
+			return fmt.Errorf("weight of profile %s must not be negative", name)
+		}
+		if err := k.hardwareConfig(&types.VirtualMachineConfigSpec{}, profile.Cpu); err != nil {
+			return fmt.Errorf("profile %s: %w", name, err)
+		}
+		total += profile.weight()
+	}
+	if len(k.Profiles) > 0 && total == 0 {
+		return fmt.Errorf("at least one profile must have a positive weight")
+	}
+	return nil
+}
+
+// provisionProfiles creates n instances, split across the profiles by
+// weight, and returns the names of those that were created. Without
+// profiles every instance uses the top-level configuration.
+func (k *vSphereDeployment) provisionProfiles(ctx context.Context, finder *find.Finder, n int) ([]string, error) {
+	if len(k.Profiles) == 0 || n <= 0 {
+		return k.provision(ctx, finder, n, k.profile(""), k.instanceName, true)
+	}
+
+	counts, err := k.profileCounts(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count instances per profile: %w", err)
+	}
+	weights := make(map[string]int)
+	for _, name := range k.profileNames() {
+		weights[name] = k.profile(name).weight()
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var created []string
+	var errs []error
+	for name, count := range allocateProfiles(weights, counts, n) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			deployed, err := k.provision(ctx, finder, count, k.profile(name), k.instanceName, true)
+
+			mu.Lock()
+			defer mu.Unlock()
+			created = append(created, deployed...)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("profile %s: %w", name, err))
+			}
+		}()
+	}
+	wg.Wait()
+
+	return created, errors.Join(errs...)
+}
+
+// profileCounts returns how many instances exist per profile.
+func (k *vSphereDeployment) profileCounts(ctx context.Context) (map[string]int, error) {
+	vms, err := k.listVMs(ctx, []string{"name", "config.extraConfig"})
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make(map[string]int)
+	for _, vm := range vms {
+		if !k.isInstance(vm.Name) {
+			continue
+		}
+		if name, ok := vmProfile(vm); ok {
+			counts[name]++
+		}
+	}
+	return counts, nil
+}
+
+// vmProfile returns the profile recorded in the VM's extraConfig.
+func vmProfile(vm mo.VirtualMachine) (string, bool) {
+	if vm.Config == nil {
+		return "", false
+	}
+	for _, opt := range vm.Config.ExtraConfig {
+		o := opt.GetOptionValue()
+		if o.Key != profileKey {
+			continue
+		}
+		name, ok := o.Value.(string)
+		return name, ok
+	}
+	return "", false
+}
+
+// allocateProfiles distributes n new instances across profiles so that,
+// together with the existing counts, the mix follows the weights as closely
+// as possible. Each instance goes to the profile that is furthest below its
+// share; ties go to the heavier, then the alphabetically first profile.
+func allocateProfiles(weights map[string]int, counts map[string]int, n int) map[string]int {
+	var names []string
+	for name, weight := range weights {
+		if weight > 0 {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+
+	alloc := make(map[string]int)
+	if len(names) == 0 {
+		return alloc
+	}
+	for range n {
+		pick := names[0]
+		for _, name := range names[1:] {
+			// Compare (count+1)/weight without floating point.
+			a := (counts[name] + alloc[name] + 1) * weights[pick]
+			b := (counts[pick] + alloc[pick] + 1) * weights[name]
+			if a < b || a == b && weights[name] > weights[pick] {
+				pick = name
+			}
+		}
+		alloc[pick]++
+	}
+	return alloc
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"maps"
+	"testing"
+
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+func TestAllocateProfiles(t *testing.T) {
+	tests := []struct {
+		name    string
+		weights map[string]int
+		counts  map[string]int
+		n       int
+		want    map[string]int
+	}{
+		{"even", map[string]int{"small": 1, "large": 1}, nil, 4, map[string]int{"small": 2, "large": 2}},
+		{"weighted", map[string]int{"small": 3, "large": 1}, nil, 4, map[string]int{"small": 3, "large": 1}},
+		{"heavier first", map[string]int{"small": 3, "large": 1}, nil, 1, map[string]int{"small": 1}},
+		{"catch up", map[string]int{"small": 1, "large": 1}, map[string]int{"small": 3}, 5, map[string]int{"small": 1, "large": 4}},
+		{"zero weight", map[string]int{"small": 1, "large": 0}, nil, 2, map[string]int{"small": 2}},
+		{"no profiles", nil, nil, 2, map[string]int{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := allocateProfiles(tt.weights, tt.counts, tt.n); !maps.Equal(got, tt.want) {
+				t.Errorf("allocateProfiles() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVSphereDeployment_Profile(t *testing.T) {
+	weight := 0
+	deployment := &vSphereDeployment{
+		Template: "ubuntu",
+		Cpu:      "2",
+		Memory:   "4096",
+		Profiles: map[string]instanceProfile{
+			"large":   {Cpu: "8", Memory: "16384"},
+			"windows": {Template: "windows", Weight: &weight},
+		},
+	}
+
+	if got := deployment.profile("large"); got.Template != "ubuntu" || got.Cpu != "8" || got.Memory != "16384" || got.weight() != 1 {
+		t.Errorf("Expected large profile to inherit the template, got %+v", got)
+	}
+	if got := deployment.profile("windows"); got.Template != "windows" || got.Cpu != "2" || got.weight() != 0 {
+		t.Errorf("Expected windows profile to inherit the size, got %+v", got)
+	}
+	if got := deployment.profile(""); got.Template != "ubuntu" || got.name != "" {
+		t.Errorf("Expected the top-level configuration, got %+v", got)
+	}
+
+	if err := deployment.validateProfiles(); err != nil {
+		t.Errorf("validateProfiles() failed: %v", err)
+	}
+	deployment.Profiles["large"] = instanceProfile{Weight: &weight}
+	if err := deployment.validateProfiles(); err == nil {
+		t.Error("Expected an error when no profile has a positive weight")
+	}
+}
+
+func TestVmProfile(t *testing.T) {
+	vm := mo.VirtualMachine{Config: &types.VirtualMachineConfigInfo{
+		ExtraConfig: []types.BaseOptionValue{&types.OptionValue{Key: profileKey, Value: "large"}},
+	}}
+	if name, ok := vmProfile(vm); !ok || name != "large" {
+		t.Errorf("vmProfile() = %q, %v", name, ok)
+	}
+	if _, ok := vmProfile(mo.VirtualMachine{}); ok {
+		t.Error("Expected no profile without config")
+	}
+}
+
+func TestVSphereDeployment_IncreaseProfiles(t *testing.T) {
+	withTestVSphere(t, func(ctx context.Context, deployment *vSphereDeployment) {
+		weight := 2
+		deployment.Profiles = map[string]instanceProfile{
+			"small": {Cpu: "1", Memory: "1024"},
+			"large": {Cpu: "4", Memory: "8192", Weight: &weight},
+		}
+
+		n, err := deployment.Increase(ctx, 3)
+		if err != nil {
+			t.Fatalf("Increase() failed: %v", err)
+		}
+		if n != 3 {
+			t.Errorf("Expected 3 instances, got %d", n)
+		}
+
+		vms, err := deployment.listVMs(ctx, []string{"name"})
+		if err != nil {
+			t.Fatalf("listVMs() failed: %v", err)
+		}
+		instances := 0
+		for _, vm := range vms {
+			if isInstanceName(deployment.Prefix, vm.Name) {
+				instances++
+			}
+		}
+		if instances != 3 {
+			t.Errorf("Expected 3 instance VMs, got %d", instances)
+		}
+	})
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vmware/govmomi/guest"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// readinessProbeTimeout bounds each individual readiness probe.
+const readinessProbeTimeout = 5 * time.Second
+
+// hasReadinessProbes reports whether any readiness probe is configured.
+func (k *vSphereDeployment) hasReadinessProbes() bool {
+	return k.ReadinessTCPPort > 0 || k.ReadinessGuestinfo != "" || k.ReadinessFile != ""
+}
+
+// probeReadiness runs the configured readiness probes against every VM that
+// would otherwise be reported as running and returns the names of those that
+// passed. A VM that passed once is not probed again.
+func (k *vSphereDeployment) probeReadiness(ctx context.Context, vms []mo.VirtualMachine, candidate func(mo.VirtualMachine) bool) map[string]bool {
+	ready := make(map[string]bool)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	for _, vm := range vms {
+		if !candidate(vm) {
+			continue
+		}
+		if !k.hasReadinessProbes() || k.isReady(vm.Name) {
+			ready[vm.Name] = true
+			continue
+		}
+
+		wg.Add(1)
+		go func(vm mo.VirtualMachine) {
+			defer wg.Done()
+
+			probeCtx, cancel := context.WithTimeout(ctx, readinessProbeTimeout)
+			defer cancel()
+
+			if err := k.probe(probeCtx, vm); err != nil {
+				k.logger().Debug("instance not ready", "instance", vm.Name, "err", err)
+				return
+			}
+
+			k.setReady(vm.Name, true)
+			mu.Lock()
+			ready[vm.Name] = true
+			mu.Unlock()
+		}(vm)
+	}
+	wg.Wait()
+
+	return ready
+}
+
+// probe runs every configured readiness probe against vm.
+func (k *vSphereDeployment) probe(ctx context.Context, vm mo.VirtualMachine) error {
+	if k.ReadinessTCPPort > 0 {
+		if err := probeTCP(ctx, k.addresses.primary(vm.Guest), k.ReadinessTCPPort); err != nil {
+			return err
+		}
+	}
+
+	if k.ReadinessGuestinfo != "" {
+		key, want, hasValue := strings.Cut(k.ReadinessGuestinfo, "=")
+
+		var vmInfo mo.VirtualMachine
+		err := object.NewVirtualMachine(k.client.Client, vm.Self).Properties(ctx, vm.Self, []string{"config.extraConfig"}, &vmInfo)
+		if err != nil {
+			return err
+		}
+		if !guestinfoMatches(vmInfo, key, want, hasValue) {
+			return fmt.Errorf("%s not set", k.ReadinessGuestinfo)
+		}
+	}
+
+	if k.ReadinessFile != "" {
+		fm, err := guest.NewOperationsManager(k.client.Client, vm.Self).FileManager(ctx)
+		if err != nil {
+			return err
+		}
+		if _, err := fm.ListFiles(ctx, k.guestAuth(), k.ReadinessFile, 0, 1, ""); err != nil {
+			return fmt.Errorf("file %s not found in guest: %w", k.ReadinessFile, err)
+		}
+	}
+
+	return nil
+}
+
+// probeTCP checks that port accepts connections on ip.
+func probeTCP(ctx context.Context, ip string, port int) error {
+	if ip == "" {
+		return fmt.Errorf("no address to probe")
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(ip, strconv.Itoa(port)))
+	if err != nil {
+		return fmt.Errorf("tcp port %d not open: %w", port, err)
+	}
+	return conn.Close()
+}
+
+// guestinfoMatches reports whether the VM's extraConfig contains key, and if
+// hasValue is set, whether it is equal to want.
+func guestinfoMatches(vm mo.VirtualMachine, key, want string, hasValue bool) bool {
+	if vm.Config == nil {
+		return false
+	}
+	for _, opt := range vm.Config.ExtraConfig {
+		o := opt.GetOptionValue()
+		if o.Key != key {
+			continue
+		}
+		value := fmt.Sprint(o.Value)
+		if hasValue {
+			return value == want
+		}
+		return value != ""
+	}
+	return false
+}
+
+// guestAuth returns the credentials used for guest operations, defaulting
+// to the connector credentials.
+func (k *vSphereDeployment) guestAuth() types.BaseGuestAuthentication {
+	username, password := k.GuestUsername, k.GuestPassword
+	if username == "" {
+		username, password = k.settings.Username, k.settings.Password
+	}
+	return &types.NamePasswordAuthentication{
+		Username: username,
+		Password: password,
+	}
+}
+
+func (k *vSphereDeployment) isReady(name string) bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	return k.ready[name]
+}
+
+// setReady records or forgets that an instance passed its readiness probes.
+func (k *vSphereDeployment) setReady(name string, ready bool) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if k.ready == nil {
+		k.ready = make(map[string]bool)
+	}
+	if ready {
+		k.ready[name] = true
+	} else {
+		delete(k.ready, name)
+	}
+}
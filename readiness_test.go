@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+func TestGuestinfoMatches(t *testing.T) {
+	vm := mo.VirtualMachine{Config: &types.VirtualMachineConfigInfo{
+		ExtraConfig: []types.BaseOptionValue{
+			&types.OptionValue{Key: "guestinfo.ready", Value: "1"},
+		},
+	}}
+
+	if !guestinfoMatches(vm, "guestinfo.ready", "1", true) {
+		t.Error("expected guestinfo.ready=1 to match")
+	}
+	if !guestinfoMatches(vm, "guestinfo.ready", "", false) {
+		t.Error("expected guestinfo.ready to be set")
+	}
+	if guestinfoMatches(vm, "guestinfo.ready", "0", true) {
+		t.Error("expected guestinfo.ready=0 not to match")
+	}
+	if guestinfoMatches(vm, "guestinfo.other", "", false) {
+		t.Error("expected guestinfo.other not to be set")
+	}
+}
+
+func TestProbeTCPPort(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() failed: %v", err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+
+	if err := probeTCP(context.Background(), "127.0.0.1", port); err != nil {
+		t.Errorf("probeTCP() failed with open port: %v", err)
+	}
+
+	ln.Close()
+	if err := probeTCP(context.Background(), "127.0.0.1", port); err == nil {
+		t.Error("probeTCP() succeeded with closed port")
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/vmware/govmomi/find"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// runReaper periodically destroys leaked instances until ctx is cancelled.
+func (k *vSphereDeployment) runReaper(ctx context.Context) {
+	defer k.wg.Done()
+
+	ticker := time.NewTicker(k.reaperInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := k.reap(ctx); err != nil {
+				k.logger().Error("reaper run failed", "err", err)
+			}
+		}
+	}
+}
+
+// reap finds instances that were left behind, for example by a runner crash,
+// and destroys them. In dry-run mode the decisions are only logged.
+func (k *vSphereDeployment) reap(ctx context.Context) error {
+	vms, err := k.listVMs(ctx, []string{"name", "runtime.powerState", "guest.net", "config.createDate", "config.extraConfig"})
+	if err != nil {
+		return err
+	}
+
+	finder := find.NewFinder(k.client.Client, true)
+	dc, err := finder.Datacenter(ctx, k.Datacenter)
+	if err != nil {
+		return err
+	}
+	finder.SetDatacenter(dc)
+
+	now := time.Now()
+	for _, vm := range vms {
+		if !isInstanceName(k.Prefix, vm.Name) || k.isInflight(vm.Name) {
+			continue
+		}
+
+		reason := k.reapReason(vm, now)
+		if reason == "" {
+			continue
+		}
+
+		if k.ReaperDryRun {
+			k.logger().Info("reaper would destroy instance", "instance", vm.Name, "reason", reason, "dry_run", true)
+			continue
+		}
+
+		k.logger().Info("reaper destroying instance", "instance", vm.Name, "reason", reason)
+		if err := deleteVMs(ctx, k.client, finder, k.Folder, []string{vm.Name}); err != nil {
+			k.logger().Error("reaper failed to destroy instance", "instance", vm.Name, "err", err)
+		}
+	}
+
+	return nil
+}
+
+// reapReason returns why vm should be reaped, or an empty string if it should
+// be kept. VMs younger than creation_timeout are always kept so that clones
+// which are still being powered on are not touched.
+func (k *vSphereDeployment) reapReason(vm mo.VirtualMachine, now time.Time) string {
+	since, knownAge := instanceSince(vm)
+	age := now.Sub(since)
+
+	if knownAge && age < k.creationTimeout {
+		return ""
+	}
+
+	if vm.Runtime.PowerState == types.VirtualMachinePowerStatePoweredOff {
+		return "powered off"
+	}
+
+	if knownAge && k.reaperMaxAge > 0 && age > k.reaperMaxAge {
+		return "exceeded max age"
+	}
+
+	// An instance that was running once keeps its job through a brief
+	// VMware Tools or network outage; only those that never came up are
+	// reaped for a missing address.
+	if knownAge && k.addresses.primary(vm.Guest) == "" && !k.hasStarted(vm.Name) {
+		return "no IP address after creation timeout"
+	}
+
+	return ""
+}
+
+// isInstanceName reports whether name follows the prefix-uuid naming used for
+// instances created by this plugin.
+func isInstanceName(prefix, name string) bool {
+	id, ok := strings.CutPrefix(name, prefix+"-")
+	if !ok {
+		return false
+	}
+	_, err := uuid.Parse(id)
+	return err == nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/vmware/govmomi/find"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+func TestReapReason(t *testing.T) {
+	now := time.Now()
+	created := func(age time.Duration) *types.VirtualMachineConfigInfo {
+		date := now.Add(-age)
+		return &types.VirtualMachineConfigInfo{CreateDate: &date}
+	}
+	withIP := &types.GuestInfo{Net: []types.GuestNicInfo{{
+		MacAddress: "00:50:56:00:00:01",
+		IpConfig:   &types.NetIpConfigInfo{},
+		IpAddress:  []string{"10.0.0.5"},
+	}}}
+
+	tests := []struct {
+		name    string
+		vm      mo.VirtualMachine
+		started bool
+		want    string
+	}{
+		{
+			name: "young powered off VM is kept",
+			vm: mo.VirtualMachine{
+				Config:  created(time.Minute),
+				Runtime: types.VirtualMachineRuntimeInfo{PowerState: types.VirtualMachinePowerStatePoweredOff},
+			},
+		},
+		{
+			name: "old powered off VM",
+			vm: mo.VirtualMachine{
+				Config:  created(time.Hour),
+				Runtime: types.VirtualMachineRuntimeInfo{PowerState: types.VirtualMachinePowerStatePoweredOff},
+			},
+			want: "powered off",
+		},
+		{
+			name: "running VM without IP",
+			vm: mo.VirtualMachine{
+				Config:  created(time.Hour),
+				Runtime: types.VirtualMachineRuntimeInfo{PowerState: types.VirtualMachinePowerStatePoweredOn},
+			},
+			want: "no IP address after creation timeout",
+		},
+		{
+			name: "started VM without IP is kept",
+			vm: mo.VirtualMachine{
+				ManagedEntity: mo.ManagedEntity{Name: "test-vm-started"},
+				Config:        created(time.Hour),
+				Runtime:       types.VirtualMachineRuntimeInfo{PowerState: types.VirtualMachinePowerStatePoweredOn},
+			},
+			started: true,
+		},
+		{
+			name: "healthy VM is kept",
+			vm: mo.VirtualMachine{
+				Config:  created(time.Hour),
+				Runtime: types.VirtualMachineRuntimeInfo{PowerState: types.VirtualMachinePowerStatePoweredOn},
+				Guest:   withIP,
+			},
+		},
+		{
+			name: "VM past max age",
+			vm: mo.VirtualMachine{
+				Config:  created(48 * time.Hour),
+				Runtime: types.VirtualMachineRuntimeInfo{PowerState: types.VirtualMachinePowerStatePoweredOn},
+				Guest:   withIP,
+			},
+			want: "exceeded max age",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			deployment := &vSphereDeployment{creationTimeout: 20 * time.Minute, reaperMaxAge: 24 * time.Hour}
+			deployment.setStarted(tt.vm.Name, tt.started)
+			if got := deployment.reapReason(tt.vm, now); got != tt.want {
+				t.Errorf("reapReason() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsInstanceName(t *testing.T) {
+	if !isInstanceName("test-vm", "test-vm-6ba7b810-9dad-11d1-80b4-00c04fd430c8") {
+		t.Error("expected prefix-uuid name to be an instance name")
+	}
+	if isInstanceName("test-vm", "test-vm-template") {
+		t.Error("expected name without uuid not to be an instance name")
+	}
+}
+
+func TestVSphereDeployment_Reap(t *testing.T) {
+	withTestVSphere(t, func(ctx context.Context, deployment *vSphereDeployment) {
+		if _, err := deployment.Increase(ctx, 1); err != nil {
+			t.Fatalf("Increase() failed: %v", err)
+		}
+
+		finder := find.NewFinder(deployment.client.Client, true)
+		dc, err := finder.Datacenter(ctx, "DC0")
+		if err != nil {
+			t.Fatalf("Could not find datacenter: %v", err)
+		}
+		finder.SetDatacenter(dc)
+
+		vms, err := finder.VirtualMachineList(ctx, "/DC0/vm/test-vm-*")
+		if err != nil || len(vms) != 1 {
+			t.Fatalf("Expected 1 VM to be created: %v", err)
+		}
+		if state, _ := vms[0].PowerState(ctx); state != types.VirtualMachinePowerStatePoweredOff {
+			task, err := vms[0].PowerOff(ctx)
+			if err != nil {
+				t.Fatalf("PowerOff() failed: %v", err)
+			}
+			if err := task.Wait(ctx); err != nil {
+				t.Fatalf("PowerOff() task failed: %v", err)
+			}
+		}
+
+		deployment.log = hclog.NewNullLogger()
+		deployment.ReaperDryRun = true
+		if err := deployment.reap(ctx); err != nil {
+			t.Fatalf("reap() failed: %v", err)
+		}
+		if _, err := finder.VirtualMachineList(ctx, "/DC0/vm/test-vm-*"); err != nil {
+			t.Fatalf("Expected dry run to keep the VM: %v", err)
+		}
+
+		deployment.ReaperDryRun = false
+		if err := deployment.reap(ctx); err != nil {
+			t.Fatalf("reap() failed: %v", err)
+		}
+		if _, err := finder.VirtualMachineList(ctx, "/DC0/vm/test-vm-*"); err == nil {
+			t.Fatal("Expected the powered off VM to be reaped")
+		}
+	})
+}
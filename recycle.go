@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/vmware/govmomi/find"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// recycleSnapshot is the snapshot taken of every clone before its first
+// boot when recycling is enabled. Recycled instances are reverted to it.
+const recycleSnapshot = "fleeting-clean"
+
+// usesKey is the extraConfig key counting how often a recycled VM has been
+// handed out as an instance.
+const usesKey = "fleeting.uses"
+
+// defaultRecycleMaxUses is the number of times a VM is used before it is
+// destroyed instead of recycled, unless recycle_max_uses is set.
+const defaultRecycleMaxUses = 10
+
+// prepareRecycle takes the clean snapshot of the powered-off clone vmName and
+// powers it on if powerOn is set.
+func (k *vSphereDeployment) prepareRecycle(ctx context.Context, finder *find.Finder, vmName string, powerOn bool) error {
+	vm, err := finder.VirtualMachine(ctx, k.Folder+vmName)
+	if err != nil {
+		return fmt.Errorf("error finding VM %s: %w", vmName, err)
+	}
+
+	task, err := vm.CreateSnapshot(ctx, recycleSnapshot, "", false, false)
+	if err == nil {
+		err = task.Wait(ctx)
+	}
+	if err != nil {
+		// The VM is still usable, it is just destroyed instead of
+		// recycled later on.
+		k.logger().Warn("failed to snapshot VM for recycling", "vm", vmName, "err", err)
+	}
+
+	if !powerOn {
+		return nil
+	}
+	task, err = vm.PowerOn(ctx)
+	if err != nil {
+		return fmt.Errorf("error powering on VM %s: %w", vmName, err)
+	}
+	if err := task.Wait(ctx); err != nil {
+		return fmt.Errorf("error powering on VM %s: %w", vmName, err)
+	}
+	return nil
+}
+
+// recycle returns as many of instances to the warm pool as it has room for
+// and returns the instances that must be destroyed instead: those beyond
+// the pool size, those used recycle_max_uses times, and those that could
+// not be reset.
+func (k *vSphereDeployment) recycle(ctx context.Context, finder *find.Finder, instances []string) []string {
+	vms, err := k.listVMs(ctx, []string{"name"})
+	if err != nil {
+		k.logger().Error("failed to list warm pool", "err", err)
+		return instances
+	}
+	room := k.WarmPoolSize
+	for _, vm := range vms {
+		if isPoolName(k.Prefix, vm.Name) {
+			room--
+		}
+	}
+
+	maxUses := k.RecycleMaxUses
+	if maxUses == 0 {
+		maxUses = defaultRecycleMaxUses
+	}
+
+	var destroy []string
+	for _, instance := range instances {
+		if room <= 0 {
+			destroy = append(destroy, instance)
+			continue
+		}
+		k.setInflight(instance, true)
+		err := k.recycleVM(ctx, finder, instance, maxUses)
+		k.setInflight(instance, false)
+		if err != nil {
+			k.logger().Info("destroying instead of recycling", "instance", instance, "reason", err)
+			destroy = append(destroy, instance)
+			continue
+		}
+		room--
+	}
+	return destroy
+}
+
+// recycleVM reverts the instance to its clean snapshot and renames it into
+// the warm pool, recording how often it has been used and clearing when it
+// was claimed.
+func (k *vSphereDeployment) recycleVM(ctx context.Context, finder *find.Finder, instance string, maxUses int) error {
+	vm, err := finder.VirtualMachine(ctx, k.Folder+instance)
+	if err != nil {
+		return fmt.Errorf("error finding VM %s: %w", instance, err)
+	}
+
+	var vmInfo mo.VirtualMachine
+	if err := vm.Properties(ctx, vm.Reference(), []string{"config.extraConfig"}, &vmInfo); err != nil {
+		return err
+	}
+	uses := vmUses(vmInfo) + 1
+	if uses >= maxUses {
+		return fmt.Errorf("used %d times", uses)
+	}
+
+	task, err := vm.RevertToSnapshot(ctx, recycleSnapshot, true)
+	if err != nil {
+		return err
+	}
+	if err := task.Wait(ctx); err != nil {
+		return fmt.Errorf("revert failed: %w", err)
+	}
+
+	// Reverting to a snapshot taken while powered off powers the VM off;
+	// make sure it is before it joins the pool.
+	state, err := vm.PowerState(ctx)
+	if err != nil {
+		return err
+	}
+	if state != types.VirtualMachinePowerStatePoweredOff {
+		task, err := vm.PowerOff(ctx)
+		if err != nil {
+			return err
+		}
+		if err := task.Wait(ctx); err != nil {
+			return fmt.Errorf("power off failed: %w", err)
+		}
+	}
+
+	// Renaming and recording the use count in one reconfiguration keeps
+	// the number of vCenter tasks down. The claim time is cleared, an empty
+	// value removes the key, so the previous use's creation deadline does
+	// not carry over; claimPoolVM records a new one.
+	name := k.poolName()
+	task, err = vm.Reconfigure(ctx, types.VirtualMachineConfigSpec{
+		Name: name,
+		ExtraConfig: []types.BaseOptionValue{
+			&types.OptionValue{Key: usesKey, Value: strconv.Itoa(uses)},
+			&types.OptionValue{Key: claimedKey, Value: ""},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if err := task.Wait(ctx); err != nil {
+		return fmt.Errorf("rename failed: %w", err)
+	}
+
+	k.logger().Info("recycled instance into warm pool", "instance", instance, "vm", name, "uses", uses)
+	return nil
+}
+
+// vmUses returns how often vm has been used as an instance before.
+func vmUses(vm mo.VirtualMachine) int {
+	if vm.Config == nil {
+		return 0
+	}
+	for _, opt := range vm.Config.ExtraConfig {
+		o := opt.GetOptionValue()
+		if o.Key != usesKey {
+			continue
+		}
+		uses, err := strconv.Atoi(fmt.Sprint(o.Value))
+		if err != nil {
+			return 0
+		}
+		return uses
+	}
+	return 0
+}
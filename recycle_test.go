@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/vmware/govmomi/simulator"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+	"gitlab.com/gitlab-org/fleeting/fleeting/provider"
+)
+
+func TestVMUses(t *testing.T) {
+	tests := []struct {
+		name string
+		vm   mo.VirtualMachine
+		want int
+	}{
+		{"no config", mo.VirtualMachine{}, 0},
+		{"never recycled", mo.VirtualMachine{Config: &types.VirtualMachineConfigInfo{}}, 0},
+		{"recycled", mo.VirtualMachine{Config: &types.VirtualMachineConfigInfo{
+			ExtraConfig: []types.BaseOptionValue{&types.OptionValue{Key: usesKey, Value: "3"}},
+		}}, 3},
+		{"invalid", mo.VirtualMachine{Config: &types.VirtualMachineConfigInfo{
+			ExtraConfig: []types.BaseOptionValue{&types.OptionValue{Key: usesKey, Value: "many"}},
+		}}, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := vmUses(tt.vm); got != tt.want {
+				t.Errorf("vmUses() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVSphereDeployment_Recycle(t *testing.T) {
+	withTestVSphere(t, func(ctx context.Context, deployment *vSphereDeployment) {
+		deployment.WarmPoolSize = 1
+		deployment.Recycle = true
+		deployment.RecycleMaxUses = 2
+
+		pool := func() []mo.VirtualMachine {
+			vms, err := deployment.listVMs(ctx, []string{"name", "runtime.powerState", "config.extraConfig"})
+			if err != nil {
+				t.Fatalf("listVMs() failed: %v", err)
+			}
+			var pool []mo.VirtualMachine
+			for _, vm := range vms {
+				if isPoolName(deployment.Prefix, vm.Name) {
+					pool = append(pool, vm)
+				}
+			}
+			return pool
+		}
+		instances := func() []string {
+			vms, err := deployment.listVMs(ctx, []string{"name"})
+			if err != nil {
+				t.Fatalf("listVMs() failed: %v", err)
+			}
+			var names []string
+			for _, vm := range vms {
+				if isInstanceName(deployment.Prefix, vm.Name) {
+					names = append(names, vm.Name)
+				}
+			}
+			return names
+		}
+
+		if _, err := deployment.Increase(ctx, 2); err != nil {
+			t.Fatalf("Increase() failed: %v", err)
+		}
+		if _, err := deployment.Decrease(ctx, instances()); err != nil {
+			t.Fatalf("Decrease() failed: %v", err)
+		}
+
+		if got := instances(); len(got) != 0 {
+			t.Errorf("Expected no instances left, got %v", got)
+		}
+		recycled := pool()
+		if len(recycled) != 1 {
+			t.Fatalf("Expected one instance to be recycled into the pool, got %d", len(recycled))
+		}
+		if state := recycled[0].Runtime.PowerState; state != types.VirtualMachinePowerStatePoweredOff {
+			t.Errorf("Expected recycled VM to be powered off, got %s", state)
+		}
+		if uses := vmUses(recycled[0]); uses != 1 {
+			t.Errorf("Expected recycled VM to be used once, got %d", uses)
+		}
+
+		if n, err := deployment.Increase(ctx, 1); err != nil || n != 1 {
+			t.Fatalf("Increase() = %d, %v", n, err)
+		}
+		if got := pool(); len(got) != 0 {
+			t.Errorf("Expected recycled VM to be taken from the pool, got %d pool VMs", len(got))
+		}
+
+		if _, err := deployment.Decrease(ctx, instances()); err != nil {
+			t.Fatalf("Decrease() failed: %v", err)
+		}
+		if got := pool(); len(got) != 0 {
+			t.Errorf("Expected VM used recycle_max_uses times to be destroyed, got %d pool VMs", len(got))
+		}
+		if got := instances(); len(got) != 0 {
+			t.Errorf("Expected no instances left, got %v", got)
+		}
+	})
+}
+
+func TestVSphereDeployment_RecycleResetsDeadline(t *testing.T) {
+	withTestModel(t, func(ctx context.Context, deployment *vSphereDeployment, model *simulator.Model) {
+		deployment.WarmPoolSize = 1
+		deployment.Recycle = true
+		deployment.creationTimeout = 20 * time.Minute
+
+		list := func(match func(string) bool) []mo.VirtualMachine {
+			vms, err := deployment.listVMs(ctx, []string{"name", "config.createDate", "config.extraConfig"})
+			if err != nil {
+				t.Fatalf("listVMs() failed: %v", err)
+			}
+			var matching []mo.VirtualMachine
+			for _, vm := range vms {
+				if match(vm.Name) {
+					matching = append(matching, vm)
+				}
+			}
+			return matching
+		}
+		recycle := func() {
+			t.Helper()
+			var names []string
+			for _, vm := range list(deployment.isInstance) {
+				names = append(names, vm.Name)
+			}
+			if _, err := deployment.Decrease(ctx, names); err != nil {
+				t.Fatalf("Decrease() failed: %v", err)
+			}
+		}
+		increase := func() {
+			t.Helper()
+			if n, err := deployment.Increase(ctx, 1); err != nil || n != 1 {
+				t.Fatalf("Increase() = %d, %v", n, err)
+			}
+		}
+
+		// The VM was cloned long ago and is used for the second time.
+		increase()
+		created := time.Now().Add(-time.Hour)
+		for _, vm := range list(deployment.isInstance) {
+			model.Map().Get(vm.Self).(*simulator.VirtualMachine).Config.CreateDate = &created
+		}
+		recycle()
+		increase()
+		recycle()
+
+		pool := list(func(name string) bool { return isPoolName(deployment.Prefix, name) })
+		if len(pool) != 1 {
+			t.Fatalf("Expected the instance to be recycled, got %d pool VMs", len(pool))
+		}
+		if since, _ := instanceSince(pool[0]); !since.Equal(created) {
+			t.Errorf("Expected the claim time to be cleared on recycle, got %v", since)
+		}
+
+		increase()
+		err := deployment.Update(ctx, func(instance string, state provider.State) {
+			if state != provider.StateCreating {
+				t.Errorf("Expected the recycled instance to be creating, got %s", state)
+			}
+		})
+		if err != nil {
+			t.Fatalf("Update() failed: %v", err)
+		}
+	})
+}
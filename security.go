@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/pbm"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// hasSecurityOptions reports whether secure boot, a vTPM or a storage policy
+// is configured.
+func (k *vSphereDeployment) hasSecurityOptions() bool {
+	return k.SecureBoot || k.VTPM || k.StoragePolicy != ""
+}
+
+// securityConfig enables secure boot, adds a vTPM and applies the storage
+// policy to the VM home and every disk of a clone of srcVM. config must
+// already hold the disk changes.
+func (k *vSphereDeployment) securityConfig(ctx context.Context, srcVM *object.VirtualMachine, config *types.VirtualMachineConfigSpec) error {
+	if !k.hasSecurityOptions() {
+		return nil
+	}
+
+	var vm mo.VirtualMachine
+	if err := srcVM.Properties(ctx, srcVM.Reference(), []string{"config.firmware", "config.hardware.device"}, &vm); err != nil {
+		return fmt.Errorf("failed to get template configuration: %w", err)
+	}
+	if vm.Config == nil {
+		return fmt.Errorf("template has no configuration")
+	}
+	devices := object.VirtualDeviceList(vm.Config.Hardware.Device)
+
+	if k.SecureBoot {
+		// Switching the firmware would leave a BIOS guest unbootable.
+		if vm.Config.Firmware != string(types.GuestOsDescriptorFirmwareTypeEfi) {
+			return fmt.Errorf("secure_boot requires a template with EFI firmware, got %s", vm.Config.Firmware)
+		}
+		config.BootOptions = &types.VirtualMachineBootOptions{EfiSecureBootEnabled: types.NewBool(true)}
+	}
+
+	if k.VTPM && len(devices.SelectByType((*types.VirtualTPM)(nil))) == 0 {
+		config.DeviceChange = append(config.DeviceChange, &types.VirtualDeviceConfigSpec{
+			Operation: types.VirtualDeviceConfigSpecOperationAdd,
+			Device:    &types.VirtualTPM{VirtualDevice: types.VirtualDevice{Key: -1}},
+		})
+	}
+
+	if k.StoragePolicy != "" {
+		id, err := k.storagePolicyID(ctx)
+		if err != nil {
+			return err
+		}
+		applyStoragePolicy(config, devices, id)
+	}
+
+	return nil
+}
+
+// storagePolicyID looks up the storage_policy and checks that it encrypts
+// if require_encryption is set.
+func (k *vSphereDeployment) storagePolicyID(ctx context.Context) (string, error) {
+	c, err := pbm.NewClient(ctx, k.client.Client)
+	if err != nil {
+		return "", fmt.Errorf("failed to connect to the storage policy service: %w", err)
+	}
+
+	id, err := c.ProfileIDByName(ctx, k.StoragePolicy)
+	if err != nil {
+		return "", fmt.Errorf("failed to find storage policy '%s': %w", k.StoragePolicy, err)
+	}
+
+	if k.RequireEncryption {
+		encrypted, err := c.SupportsEncryption(ctx, id)
+		if err != nil {
+			return "", fmt.Errorf("failed to check encryption of storage policy '%s': %w", k.StoragePolicy, err)
+		}
+		if !encrypted {
+			return "", fmt.Errorf("storage policy '%s' does not encrypt", k.StoragePolicy)
+		}
+	}
+	return id, nil
+}
+
+// applyStoragePolicy applies the storage policy id to the VM home and to
+// every disk, both those of the template in devices and those config adds.
+func applyStoragePolicy(config *types.VirtualMachineConfigSpec, devices object.VirtualDeviceList, id string) {
+	profile := func() []types.BaseVirtualMachineProfileSpec {
+		return []types.BaseVirtualMachineProfileSpec{&types.VirtualMachineDefinedProfileSpec{ProfileId: id}}
+	}
+	config.VmProfile = profile()
+
+	changed := make(map[int32]bool)
+	for _, change := range config.DeviceChange {
+		spec := change.GetVirtualDeviceConfigSpec()
+		if disk, ok := spec.Device.(*types.VirtualDisk); ok {
+			spec.Profile = profile()
+			changed[disk.Key] = true
+		}
+	}
+
+	for _, device := range devices.SelectByType((*types.VirtualDisk)(nil)) {
+		if changed[device.GetVirtualDevice().Key] {
+			continue
+		}
+		config.DeviceChange = append(config.DeviceChange, &types.VirtualDeviceConfigSpec{
+			Operation: types.VirtualDeviceConfigSpecOperationEdit,
+			Device:    device,
+			Profile:   profile(),
+		})
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/vmware/govmomi/find"
+	"github.com/vmware/govmomi/object"
+	pbmsim "github.com/vmware/govmomi/pbm/simulator"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+func TestVSphereDeployment_SecurityConfig(t *testing.T) {
+	withTestVSphere(t, func(ctx context.Context, deployment *vSphereDeployment) {
+		finder := find.NewFinder(deployment.client.Client, true)
+		dc, err := finder.Datacenter(ctx, "DC0")
+		if err != nil {
+			t.Fatalf("Failed to find datacenter: %v", err)
+		}
+		finder.SetDatacenter(dc)
+		template, err := finder.VirtualMachine(ctx, deployment.Template)
+		if err != nil {
+			t.Fatalf("Failed to find template: %v", err)
+		}
+
+		deployment.SecureBoot = true
+		if _, err := deployment.cloneConfig(ctx, finder, template, deployment.profile("")); err == nil {
+			t.Error("Expected secure boot to require an EFI template")
+		}
+		setFirmware(ctx, t, template, types.GuestOsDescriptorFirmwareTypeEfi)
+
+		deployment.VTPM = true
+		deployment.StoragePolicy = "VM Encryption Policy"
+		deployment.RequireEncryption = true
+		config, err := deployment.cloneConfig(ctx, finder, template, deployment.profile(""))
+		if err != nil {
+			t.Fatalf("cloneConfig() failed: %v", err)
+		}
+
+		if config.BootOptions == nil || config.BootOptions.EfiSecureBootEnabled == nil || !*config.BootOptions.EfiSecureBootEnabled {
+			t.Error("Expected secure boot to be enabled")
+		}
+		if len(config.VmProfile) != 1 || config.VmProfile[0].(*types.VirtualMachineDefinedProfileSpec).ProfileId != pbmsim.DefaultEncryptionProfileID {
+			t.Errorf("Expected the encryption policy on the VM home, got %+v", config.VmProfile)
+		}
+
+		var tpm, disks int
+		for _, change := range config.DeviceChange {
+			spec := change.GetVirtualDeviceConfigSpec()
+			switch spec.Device.(type) {
+			case *types.VirtualTPM:
+				tpm++
+			case *types.VirtualDisk:
+				disks++
+				if len(spec.Profile) != 1 {
+					t.Errorf("Expected the storage policy on disk %d", spec.Device.GetVirtualDevice().Key)
+				}
+			}
+		}
+		if tpm != 1 {
+			t.Errorf("Expected one vTPM to be added, got %d", tpm)
+		}
+		if disks != 1 {
+			t.Errorf("Expected the template disk to be edited, got %d disk changes", disks)
+		}
+
+		deployment.StoragePolicy = "vSAN Default Storage Policy"
+		if _, err := deployment.cloneConfig(ctx, finder, template, deployment.profile("")); err == nil {
+			t.Error("Expected an error for a storage policy that does not encrypt")
+		}
+	})
+}
+
+// setFirmware reconfigures vm to boot with firmware.
+func setFirmware(ctx context.Context, t *testing.T, vm *object.VirtualMachine, firmware types.GuestOsDescriptorFirmwareType) {
+	t.Helper()
+
+	task, err := vm.Reconfigure(ctx, types.VirtualMachineConfigSpec{Firmware: string(firmware)})
+	if err != nil {
+		t.Fatalf("Failed to reconfigure template: %v", err)
+	}
+	if err := task.Wait(ctx); err != nil {
+		t.Fatalf("Failed to reconfigure template: %v", err)
+	}
+}
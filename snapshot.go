@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vim25/methods"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// defaultManagedSnapshot is the name of the template snapshot created by the
+// plugin when manage_snapshot is set and no snapshot name is configured.
+const defaultManagedSnapshot = "fleeting-base"
+
+// managedSnapshotPrefix starts the description of managed snapshots; it is
+// followed by the template's config.changeVersion the snapshot was taken at.
+const managedSnapshotPrefix = "fleeting template changeVersion: "
+
+// maxManagedSnapshots caps the managed snapshots kept on the template, so
+// that its snapshot chain cannot grow until it hits vSphere's depth limit.
+const maxManagedSnapshots = 8
+
+// linkedCloneSnapshot returns the template snapshot linked clones are based
+// on.
+func (k *vSphereDeployment) linkedCloneSnapshot(ctx context.Context, vm *object.VirtualMachine) (*types.ManagedObjectReference, error) {
+	if !k.ManageSnapshot {
+		return templateSnapshot(ctx, vm, k.Snapshot)
+	}
+	return k.ensureTemplateSnapshot(ctx, vm)
+}
+
+// ensureTemplateSnapshot returns the managed snapshot of the template,
+// taking a new one if there is none yet or the template's configuration
+// changed since the last one was taken. Superseded snapshots are removed once
+// no linked clone depends on them; if maxManagedSnapshots are still in use,
+// no new snapshot is taken and an error is returned.
+func (k *vSphereDeployment) ensureTemplateSnapshot(ctx context.Context, vm *object.VirtualMachine) (*types.ManagedObjectReference, error) {
+	k.snapshotMu.Lock()
+	defer k.snapshotMu.Unlock()
+
+	name := k.Snapshot
+	if name == "" {
+		name = defaultManagedSnapshot
+	}
+
+	var vmInfo mo.VirtualMachine
+	if err := vm.Properties(ctx, vm.Reference(), []string{"config.changeVersion", "snapshot"}, &vmInfo); err != nil {
+		return nil, err
+	}
+	if vmInfo.Config == nil {
+		return nil, fmt.Errorf("template has no configuration")
+	}
+	version := vmInfo.Config.ChangeVersion
+
+	var current *types.VirtualMachineSnapshotTree
+	var managed []types.ManagedObjectReference
+	if vmInfo.Snapshot != nil {
+		current = latestSnapshot(vmInfo.Snapshot.RootSnapshotList, name)
+		managed = managedSnapshots(vmInfo.Snapshot.RootSnapshotList, name)
+	}
+	if current != nil && current.Description == managedSnapshotPrefix+version {
+		if len(managed) > 1 && len(k.pruneTemplateSnapshots(ctx, vm, managed, &current.Snapshot)) < len(managed) {
+			// Removing snapshots consolidates the template's disks, which
+			// may bump its change version like taking one does.
+			if err := k.recordSnapshotVersion(ctx, vm, current.Snapshot, version); err != nil {
+				return nil, err
+			}
+		}
+		return &current.Snapshot, nil
+	}
+
+	if len(managed) > 0 {
+		managed = k.pruneTemplateSnapshots(ctx, vm, managed, nil)
+	}
+	if len(managed) >= maxManagedSnapshots {
+		return nil, fmt.Errorf("template has %d managed snapshots still used by linked clones, not taking another one until older instances are gone", len(managed))
+	}
+
+	if current == nil {
+		k.logger().Info("creating template snapshot", "snapshot", name)
+	} else {
+		k.logger().Info("template changed, creating new template snapshot", "snapshot", name, "previous", current.CreateTime)
+	}
+
+	task, err := vm.CreateSnapshot(ctx, name, managedSnapshotPrefix+version, false, false)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create template snapshot: %w", err)
+	}
+	info, err := task.WaitForResult(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create template snapshot: %w", err)
+	}
+	ref, ok := info.Result.(types.ManagedObjectReference)
+	if !ok {
+		return nil, fmt.Errorf("failed to create template snapshot: unexpected task result %T", info.Result)
+	}
+
+	// Taking a snapshot changes the template's disk backings, which bumps
+	// its change version on vCenter.
+	if err := k.recordSnapshotVersion(ctx, vm, ref, version); err != nil {
+		return nil, err
+	}
+
+	return &ref, nil
+}
+
+// recordSnapshotVersion updates the description of the managed snapshot
+// from the recorded change version to the one the template has now, so the
+// snapshot is not taken to be stale after the plugin itself changed the
+// template's disk backings.
+func (k *vSphereDeployment) recordSnapshotVersion(ctx context.Context, vm *object.VirtualMachine, snapshot types.ManagedObjectReference, recorded string) error {
+	var vmInfo mo.VirtualMachine
+	if err := vm.Properties(ctx, vm.Reference(), []string{"config.changeVersion"}, &vmInfo); err != nil {
+		return err
+	}
+	if vmInfo.Config == nil || vmInfo.Config.ChangeVersion == recorded {
+		return nil
+	}
+
+	_, err := methods.RenameSnapshot(ctx, k.client.Client, &types.RenameSnapshot{
+		This:        snapshot,
+		Description: managedSnapshotPrefix + vmInfo.Config.ChangeVersion,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update template snapshot description: %w", err)
+	}
+	return nil
+}
+
+// pruneTemplateSnapshots removes the managed snapshots of the template that
+// no linked clone in the folder is based on, apart from keep, and returns
+// those that remain. Failures are logged; the snapshots are retried later.
+func (k *vSphereDeployment) pruneTemplateSnapshots(ctx context.Context, vm *object.VirtualMachine,
+	managed []types.ManagedObjectReference, keep *types.ManagedObjectReference) []types.ManagedObjectReference {
+	var vmInfo mo.VirtualMachine
+	if err := vm.Properties(ctx, vm.Reference(), []string{"layoutEx"}, &vmInfo); err != nil {
+		k.logger().Warn("failed to get template disk layout", "err", err)
+		return managed
+	}
+	clones, err := k.listVMs(ctx, []string{"config.hardware.device"})
+	if err != nil {
+		k.logger().Warn("failed to list linked clones", "err", err)
+		return managed
+	}
+
+	// A linked clone depends on the snapshot whose disk is the parent of
+	// its own. The template's own chain runs through every snapshot, so it
+	// is skipped.
+	inUse := make(map[string]bool)
+	for _, clone := range clones {
+		if clone.Config == nil || clone.Self == vm.Reference() {
+			continue
+		}
+		for _, device := range object.VirtualDeviceList(clone.Config.Hardware.Device).SelectByType((*types.VirtualDisk)(nil)) {
+			if file := diskParentFile(device.(*types.VirtualDisk).Backing); file != "" {
+				inUse[file] = true
+			}
+		}
+	}
+
+	var remaining []types.ManagedObjectReference
+	for _, snapshot := range managed {
+		if keep != nil && snapshot == *keep || snapshotInUse(vmInfo.LayoutEx, snapshot, inUse) {
+			remaining = append(remaining, snapshot)
+			continue
+		}
+
+		k.logger().Info("removing unused template snapshot", "snapshot", snapshot.Value)
+		consolidate := true
+		res, err := methods.RemoveSnapshot_Task(ctx, k.client.Client, &types.RemoveSnapshot_Task{
+			This:           snapshot,
+			RemoveChildren: false,
+			Consolidate:    &consolidate,
+		})
+		if err == nil {
+			err = object.NewTask(k.client.Client, res.Returnval).Wait(ctx)
+		}
+		if err != nil {
+			k.logger().Warn("failed to remove template snapshot", "snapshot", snapshot.Value, "err", err)
+			remaining = append(remaining, snapshot)
+		}
+	}
+	return remaining
+}
+
+// snapshotInUse reports whether any disk file the snapshot captured is in
+// inUse. A snapshot that is missing from the layout is taken to be in use.
+func snapshotInUse(layout *types.VirtualMachineFileLayoutEx, snapshot types.ManagedObjectReference, inUse map[string]bool) bool {
+	if layout == nil {
+		return true
+	}
+	names := make(map[int32]string)
+	for _, file := range layout.File {
+		names[file.Key] = file.Name
+	}
+	for _, s := range layout.Snapshot {
+		if s.Key != snapshot {
+			continue
+		}
+		for _, disk := range s.Disk {
+			if len(disk.Chain) == 0 {
+				continue
+			}
+			// Clones of the snapshot use the newest disk in its chain.
+			for _, key := range disk.Chain[len(disk.Chain)-1].FileKey {
+				if inUse[names[key]] {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// diskParentFile returns the file name of the parent of a linked clone's
+// disk backing, or an empty string if the disk has no parent.
+func diskParentFile(backing types.BaseVirtualDeviceBackingInfo) string {
+	var parent types.BaseVirtualDeviceFileBackingInfo
+	switch b := backing.(type) {
+	case *types.VirtualDiskFlatVer2BackingInfo:
+		if b.Parent != nil {
+			parent = b.Parent
+		}
+	case *types.VirtualDiskSeSparseBackingInfo:
+		if b.Parent != nil {
+			parent = b.Parent
+		}
+	case *types.VirtualDiskSparseVer2BackingInfo:
+		if b.Parent != nil {
+			parent = b.Parent
+		}
+	}
+	if parent == nil {
+		return ""
+	}
+	return parent.GetVirtualDeviceFileBackingInfo().FileName
+}
+
+// managedSnapshots returns the snapshots named name in the snapshot tree that
+// were taken by the plugin.
+func managedSnapshots(trees []types.VirtualMachineSnapshotTree, name string) []types.ManagedObjectReference {
+	var refs []types.ManagedObjectReference
+	for _, tree := range trees {
+		if tree.Name == name && strings.HasPrefix(tree.Description, managedSnapshotPrefix) {
+			refs = append(refs, tree.Snapshot)
+		}
+		refs = append(refs, managedSnapshots(tree.ChildSnapshotList, name)...)
+	}
+	return refs
+}
+
+// latestSnapshot returns the most recently created snapshot named name in
+// the snapshot tree, or nil if there is none.
+func latestSnapshot(trees []types.VirtualMachineSnapshotTree, name string) *types.VirtualMachineSnapshotTree {
+	var latest *types.VirtualMachineSnapshotTree
+	for i := range trees {
+		tree := &trees[i]
+		if tree.Name == name && (latest == nil || tree.CreateTime.After(latest.CreateTime)) {
+			latest = tree
+		}
+		if child := latestSnapshot(tree.ChildSnapshotList, name); child != nil &&
+			(latest == nil || child.CreateTime.After(latest.CreateTime)) {
+			latest = child
+		}
+	}
+	return latest
+}
+
+// templateSnapshot returns the named snapshot of vm, or its current snapshot
+// if name is empty.
+func templateSnapshot(ctx context.Context, vm *object.VirtualMachine, name string) (*types.ManagedObjectReference, error) {
+	if name != "" {
+		ref, err := vm.FindSnapshot(ctx, name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find snapshot '%s': %v", name, err)
+		}
+		return ref, nil
+	}
+
+	var vmInfo mo.VirtualMachine
+	if err := vm.Properties(ctx, vm.Reference(), []string{"snapshot"}, &vmInfo); err != nil {
+		return nil, err
+	}
+	if vmInfo.Snapshot == nil || vmInfo.Snapshot.CurrentSnapshot == nil {
+		return nil, fmt.Errorf("template has no snapshot")
+	}
+	return vmInfo.Snapshot.CurrentSnapshot, nil
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/vmware/govmomi/find"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/simulator"
+	"github.com/vmware/govmomi/vim25/methods"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/soap"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+func TestLatestSnapshot(t *testing.T) {
+	now := time.Now()
+	trees := []types.VirtualMachineSnapshotTree{{
+		Name:       "fleeting-base",
+		CreateTime: now.Add(-2 * time.Hour),
+		Snapshot:   types.ManagedObjectReference{Type: "VirtualMachineSnapshot", Value: "snapshot-1"},
+		ChildSnapshotList: []types.VirtualMachineSnapshotTree{{
+			Name:       "other",
+			CreateTime: now.Add(-time.Hour),
+			Snapshot:   types.ManagedObjectReference{Type: "VirtualMachineSnapshot", Value: "snapshot-2"},
+			ChildSnapshotList: []types.VirtualMachineSnapshotTree{{
+				Name:       "fleeting-base",
+				CreateTime: now,
+				Snapshot:   types.ManagedObjectReference{Type: "VirtualMachineSnapshot", Value: "snapshot-3"},
+			}},
+		}},
+	}}
+
+	if got := latestSnapshot(trees, "fleeting-base"); got == nil || got.Snapshot.Value != "snapshot-3" {
+		t.Errorf("latestSnapshot() = %v, want snapshot-3", got)
+	}
+	if got := latestSnapshot(trees, "missing"); got != nil {
+		t.Errorf("latestSnapshot() = %v, want nil", got)
+	}
+}
+
+func TestVSphereDeployment_ManageSnapshot(t *testing.T) {
+	withTestVSphere(t, func(ctx context.Context, deployment *vSphereDeployment) {
+		deployment.Deploytype = "linkedclone"
+		deployment.ManageSnapshot = true
+
+		finder := find.NewFinder(deployment.client.Client, true)
+		dc, err := finder.Datacenter(ctx, "DC0")
+		if err != nil {
+			t.Fatalf("Could not find datacenter: %v", err)
+		}
+		finder.SetDatacenter(dc)
+
+		template, err := finder.VirtualMachine(ctx, deployment.Template)
+		if err != nil {
+			t.Fatalf("Could not find template: %v", err)
+		}
+
+		first, err := deployment.ensureTemplateSnapshot(ctx, template)
+		if err != nil {
+			t.Fatalf("ensureTemplateSnapshot() failed: %v", err)
+		}
+		again, err := deployment.ensureTemplateSnapshot(ctx, template)
+		if err != nil {
+			t.Fatalf("ensureTemplateSnapshot() failed: %v", err)
+		}
+		if *again != *first {
+			t.Errorf("Expected unchanged template to reuse snapshot %v, got %v", first, again)
+		}
+
+		task, err := template.Reconfigure(ctx, types.VirtualMachineConfigSpec{Annotation: "new base image"})
+		if err != nil {
+			t.Fatalf("Reconfigure() failed: %v", err)
+		}
+		if err := task.Wait(ctx); err != nil {
+			t.Fatalf("Reconfigure() task failed: %v", err)
+		}
+
+		changed, err := deployment.ensureTemplateSnapshot(ctx, template)
+		if err != nil {
+			t.Fatalf("ensureTemplateSnapshot() failed: %v", err)
+		}
+		if *changed == *first {
+			t.Error("Expected changed template to get a new snapshot")
+		}
+
+		var vmInfo mo.VirtualMachine
+		if err := template.Properties(ctx, template.Reference(), []string{"snapshot"}, &vmInfo); err != nil {
+			t.Fatalf("Could not get template snapshots: %v", err)
+		}
+		if got := latestSnapshot(vmInfo.Snapshot.RootSnapshotList, defaultManagedSnapshot); got == nil || got.Snapshot != *changed {
+			t.Errorf("Expected latest %s snapshot to be %v, got %v", defaultManagedSnapshot, changed, got)
+		}
+		if got := managedSnapshots(vmInfo.Snapshot.RootSnapshotList, defaultManagedSnapshot); len(got) != 1 {
+			t.Errorf("Expected the unused superseded snapshot to be removed, got %v", got)
+		}
+
+		n, err := deployment.Increase(ctx, 1)
+		if err != nil {
+			t.Fatalf("Increase() failed: %v", err)
+		}
+		if n != 1 {
+			t.Errorf("Expected to increase by 1, but got %d", n)
+		}
+	})
+}
+
+// consolidatingSnapshot extends a simulator snapshot to behave like vCenter:
+// removing it consolidates the VM's disks, which bumps the VM's change
+// version, and it can be renamed.
+type consolidatingSnapshot struct {
+	*simulator.VirtualMachineSnapshot
+}
+
+func (s *consolidatingSnapshot) RemoveSnapshotTask(ctx *simulator.Context, req *types.RemoveSnapshot_Task) soap.HasFault {
+	vm := ctx.Map.Get(s.Vm).(*simulator.VirtualMachine)
+	ctx.WithLock(vm, func() {
+		ctx.Update(vm, []types.PropertyChange{{Name: "config.changeVersion", Val: "consolidated"}})
+	})
+	// The simulator expects its own type in the registry when removing.
+	ctx.Map.Put(s.VirtualMachineSnapshot)
+	return s.VirtualMachineSnapshot.RemoveSnapshotTask(ctx, req)
+}
+
+func (s *consolidatingSnapshot) RenameSnapshot(ctx *simulator.Context, req *types.RenameSnapshot) soap.HasFault {
+	vm := ctx.Map.Get(s.Vm).(*simulator.VirtualMachine)
+	ctx.WithLock(vm, func() {
+		var rename func(trees []types.VirtualMachineSnapshotTree)
+		rename = func(trees []types.VirtualMachineSnapshotTree) {
+			for i := range trees {
+				if trees[i].Snapshot == req.This {
+					trees[i].Description = req.Description
+				}
+				rename(trees[i].ChildSnapshotList)
+			}
+		}
+		rename(vm.Snapshot.RootSnapshotList)
+		ctx.Update(vm, []types.PropertyChange{{Name: "snapshot.rootSnapshotList", Val: vm.Snapshot.RootSnapshotList}})
+	})
+	return &methods.RenameSnapshotBody{Res: &types.RenameSnapshotResponse{}}
+}
+
+func TestVSphereDeployment_ManageSnapshotAfterPrune(t *testing.T) {
+	withTestModel(t, func(ctx context.Context, deployment *vSphereDeployment, model *simulator.Model) {
+		deployment.Deploytype = "linkedclone"
+		deployment.ManageSnapshot = true
+
+		finder := find.NewFinder(deployment.client.Client, true)
+		dc, err := finder.Datacenter(ctx, "DC0")
+		if err != nil {
+			t.Fatalf("Could not find datacenter: %v", err)
+		}
+		finder.SetDatacenter(dc)
+		template, err := finder.VirtualMachine(ctx, deployment.Template)
+		if err != nil {
+			t.Fatalf("Could not find template: %v", err)
+		}
+
+		// A superseded snapshot and a current one, as left behind when the
+		// superseded one was still in use when the current one was taken.
+		var vmInfo mo.VirtualMachine
+		if err := template.Properties(ctx, template.Reference(), []string{"config.changeVersion"}, &vmInfo); err != nil {
+			t.Fatalf("Could not get template change version: %v", err)
+		}
+		superseded := createSnapshot(ctx, t, template, managedSnapshotPrefix+"superseded")
+		current := createSnapshot(ctx, t, template, managedSnapshotPrefix+vmInfo.Config.ChangeVersion)
+		for _, ref := range []types.ManagedObjectReference{superseded, current} {
+			snapshot := model.Map().Get(ref).(*simulator.VirtualMachineSnapshot)
+			model.Map().Put(&consolidatingSnapshot{snapshot})
+		}
+
+		got, err := deployment.ensureTemplateSnapshot(ctx, template)
+		if err != nil {
+			t.Fatalf("ensureTemplateSnapshot() failed: %v", err)
+		}
+		if *got != current {
+			t.Fatalf("Expected the current snapshot %v, got %v", current, got)
+		}
+
+		// Removing the superseded snapshot bumped the change version, which
+		// must not make the current snapshot look stale.
+		again, err := deployment.ensureTemplateSnapshot(ctx, template)
+		if err != nil {
+			t.Fatalf("ensureTemplateSnapshot() failed: %v", err)
+		}
+		if *again != current {
+			t.Errorf("Expected the current snapshot %v to be reused after pruning, got %v", current, again)
+		}
+	})
+}
+
+// createSnapshot takes a snapshot of vm named like a managed snapshot.
+func createSnapshot(ctx context.Context, t *testing.T, vm *object.VirtualMachine, description string) types.ManagedObjectReference {
+	t.Helper()
+
+	task, err := vm.CreateSnapshot(ctx, defaultManagedSnapshot, description, false, false)
+	if err != nil {
+		t.Fatalf("CreateSnapshot() failed: %v", err)
+	}
+	info, err := task.WaitForResult(ctx)
+	if err != nil {
+		t.Fatalf("CreateSnapshot() task failed: %v", err)
+	}
+	return info.Result.(types.ManagedObjectReference)
+}
+
+func TestSnapshotInUse(t *testing.T) {
+	base := types.ManagedObjectReference{Type: "VirtualMachineSnapshot", Value: "snapshot-1"}
+	next := types.ManagedObjectReference{Type: "VirtualMachineSnapshot", Value: "snapshot-2"}
+	layout := &types.VirtualMachineFileLayoutEx{
+		File: []types.VirtualMachineFileLayoutExFileInfo{
+			{Key: 1, Name: "[ds] template/template.vmdk"},
+			{Key: 2, Name: "[ds] template/template-000001.vmdk"},
+		},
+		Snapshot: []types.VirtualMachineFileLayoutExSnapshotLayout{
+			{Key: base, Disk: []types.VirtualMachineFileLayoutExDiskLayout{{
+				Chain: []types.VirtualMachineFileLayoutExDiskUnit{{FileKey: []int32{1}}},
+			}}},
+			{Key: next, Disk: []types.VirtualMachineFileLayoutExDiskLayout{{
+				Chain: []types.VirtualMachineFileLayoutExDiskUnit{{FileKey: []int32{1}}, {FileKey: []int32{2}}},
+			}}},
+		},
+	}
+	inUse := map[string]bool{"[ds] template/template-000001.vmdk": true}
+
+	if snapshotInUse(layout, base, inUse) {
+		t.Error("Expected the base snapshot not to be in use")
+	}
+	if !snapshotInUse(layout, next, inUse) {
+		t.Error("Expected the snapshot a clone is based on to be in use")
+	}
+	if !snapshotInUse(layout, types.ManagedObjectReference{Type: "VirtualMachineSnapshot", Value: "unknown"}, inUse) {
+		t.Error("Expected a snapshot missing from the layout to be kept")
+	}
+}
+
+func TestDiskParentFile(t *testing.T) {
+	backing := &types.VirtualDiskFlatVer2BackingInfo{
+		VirtualDeviceFileBackingInfo: types.VirtualDeviceFileBackingInfo{FileName: "[ds] clone/clone.vmdk"},
+		Parent: &types.VirtualDiskFlatVer2BackingInfo{
+			VirtualDeviceFileBackingInfo: types.VirtualDeviceFileBackingInfo{FileName: "[ds] template/template-000001.vmdk"},
+		},
+	}
+	if got := diskParentFile(backing); got != "[ds] template/template-000001.vmdk" {
+		t.Errorf("diskParentFile() = %q", got)
+	}
+	if got := diskParentFile(backing.Parent); got != "" {
+		t.Errorf("Expected no parent for a full disk, got %q", got)
+	}
+}